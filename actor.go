@@ -0,0 +1,249 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor"
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+var actorsKey = datastore.NewKey("/actors")
+
+func init() {
+	cbornode.RegisterCborType(ActorEntry{})
+}
+
+// ActorEntry is a node in the history of an actor. Every message processed by
+// the actor appends a new entry pointing to the previous one, so the whole
+// history can be replayed from the genesis entry.
+type ActorEntry struct {
+	Fn    cid.Cid  // ABI of the function implementing the actor.
+	Fx    string   // Name of the function handling messages.
+	State cid.Cid  // State of the actor after processing Msg, a dag-cbor node.
+	Msg   *cid.Cid `refmt:",omitempty"` // Message processed. Nil for the genesis entry.
+	Reply *cid.Cid `refmt:",omitempty"` // Reply to the message, a dag-cbor node, if any.
+	Prev  *cid.Cid `refmt:",omitempty"` // Previous entry.
+}
+
+// ActorOutput is what an actor function returns, encoded in CBOR. The
+// function receives the CBOR encoding of the current state and the message as
+// arguments, and returns the new state and the reply as CBOR values, which
+// are stored as dag-cbor nodes. The reply can be left out.
+type ActorOutput struct {
+	State cbor.RawMessage
+	Reply cbor.RawMessage
+}
+
+// actorLocks serializes the messages sent to each actor. Locks are only kept
+// while some caller holds or waits for them.
+type actorLocks struct {
+	lk    sync.Mutex
+	locks map[string]*actorLock
+}
+
+type actorLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks an actor and returns the function unlocking it.
+func (a *actorLocks) lock(id string) func() {
+	a.lk.Lock()
+	if a.locks == nil {
+		a.locks = make(map[string]*actorLock)
+	}
+	l, ok := a.locks[id]
+	if !ok {
+		l = &actorLock{}
+		a.locks[id] = l
+	}
+	l.refs++
+	a.lk.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		a.lk.Lock()
+		defer a.lk.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(a.locks, id)
+		}
+	}
+}
+
+// actorKey returns the key of the head of an actor in the datastore.
+func actorKey(id string) (datastore.Key, error) {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return datastore.Key{}, fmt.Errorf("invalid actor id %q", id)
+	}
+	return actorsKey.ChildString(id), nil
+}
+
+// SpawnActor creates an actor with the given id handling messages with fx
+// from the function deployed at fnCid. state is the initial state of the
+// actor, either a dag-cbor node or a UnixFS file with its CBOR encoding. It
+// returns the CID of the genesis entry.
+func (p *Peer) SpawnActor(ctx context.Context, id string, fnCid cid.Cid, fx string, state cid.Cid) (*cid.Cid, error) {
+	key, err := actorKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer p.actors.lock(id)()
+
+	if has, err := p.store.Has(key); err != nil {
+		return nil, err
+	} else if has {
+		return nil, fmt.Errorf("actor %s already exists", id)
+	}
+
+	return p.appendActorEntry(ctx, key, &ActorEntry{Fn: fnCid, Fx: fx, State: state})
+}
+
+// ActorHead returns the current head of an actor.
+func (p *Peer) ActorHead(ctx context.Context, id string) (*ActorEntry, *cid.Cid, error) {
+	key, err := actorKey(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := p.store.Get(key)
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			return nil, nil, fmt.Errorf("actor %s not found", id)
+		}
+		return nil, nil, err
+	}
+	head, err := cid.Cast(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry, err := p.GetActorEntry(ctx, head)
+	if err != nil {
+		return nil, nil, err
+	}
+	return entry, &head, nil
+}
+
+// GetActorEntry fetches an entry of the history of an actor.
+func (p *Peer) GetActorEntry(ctx context.Context, c cid.Cid) (*ActorEntry, error) {
+	n, err := p.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	entry := ActorEntry{}
+	if err := cbornode.DecodeInto(n.RawData(), &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Send a message to an actor. Messages to the same actor are processed one
+// at a time. It returns the new head of the actor, which includes the new
+// state and the reply to the message.
+func (p *Peer) Send(ctx context.Context, id string, msg cid.Cid) (*ActorEntry, error) {
+	key, err := actorKey(id)
+	if err != nil {
+		return nil, err
+	}
+	defer p.actors.lock(id)()
+
+	head, headCid, err := p.ActorHead(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	abi, err := p.runnableABI(ctx, head.Fn)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := p.actorData(ctx, head.State)
+	if err != nil {
+		return nil, err
+	}
+	m, err := p.actorData(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	ex, err := p.execute(ctx, abi, head.Fx, [][]byte{state, m})
+	if err != nil {
+		return nil, err
+	}
+	res := ActorOutput{}
+	if err := cbor.Unmarshal(ex.output, &res); err != nil {
+		return nil, fmt.Errorf("couldn't decode actor output: %s", err)
+	}
+
+	newState, err := p.addCBOR(ctx, res.State)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode actor state: %s", err)
+	}
+	entry := &ActorEntry{
+		Fn:    head.Fn,
+		Fx:    head.Fx,
+		State: newState,
+		Msg:   &msg,
+		Prev:  headCid,
+	}
+	if len(res.Reply) > 0 {
+		reply, err := p.addCBOR(ctx, res.Reply)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode actor reply: %s", err)
+		}
+		entry.Reply = &reply
+	}
+	if _, err := p.appendActorEntry(ctx, key, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// actorData returns the CBOR encoding held by a dag-cbor node, or the
+// contents of a UnixFS file or the output of a thunk.
+func (p *Peer) actorData(ctx context.Context, c cid.Cid) ([]byte, error) {
+	if c.Type() != cid.DagCBOR {
+		return p.fetch(ctx, c)
+	}
+	n, err := p.Get(ctx, c)
+	if err != nil {
+		return nil, &FetchError{Cid: c, Err: err}
+	}
+	if _, ok := asThunk(n); ok {
+		return p.fetch(ctx, c)
+	}
+	return n.RawData(), nil
+}
+
+// addCBOR adds a CBOR value as a dag-cbor node.
+func (p *Peer) addCBOR(ctx context.Context, b []byte) (cid.Cid, error) {
+	n, err := cbornode.Decode(b, multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := p.Add(ctx, n); err != nil {
+		return cid.Undef, err
+	}
+	return n.Cid(), nil
+}
+
+// appendActorEntry adds the entry to the DAG and makes it the new head.
+func (p *Peer) appendActorEntry(ctx context.Context, key datastore.Key, entry *ActorEntry) (*cid.Cid, error) {
+	n, err := cbornode.WrapObject(entry, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Add(ctx, n); err != nil {
+		return nil, err
+	}
+	c := n.Cid()
+	if err := p.store.Put(key, c.Bytes()); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
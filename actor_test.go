@@ -0,0 +1,128 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+)
+
+// counterWat is an actor whose state is a CBOR integer below 24 that is
+// incremented by every message, and replied with.
+const counterWat = `(module
+	(memory (export "memory") 1)
+	(global $heap (mut i32) (i32.const 1024))
+	;; {"State": 0, "Reply": 0}
+	(data (i32.const 16) "\a2\65State\00\65Reply\00")
+	(func (export "alloc") (param $size i32) (result i32)
+		(local $ptr i32)
+		(local.set $ptr (global.get $heap))
+		(global.set $heap (i32.add (global.get $heap) (local.get $size)))
+		(local.get $ptr))
+	(func (export "count") (param $ptr i32) (param $state i32) (param $msg i32) (result i32)
+		(local $n i32)
+		(local.set $n (i32.add (i32.load8_u (local.get $ptr)) (i32.const 1)))
+		(i64.store (local.get $ptr) (i64.load (i32.const 16)))
+		(i64.store (i32.add (local.get $ptr) (i32.const 8)) (i64.load (i32.const 24)))
+		(i32.store8 (i32.add (local.get $ptr) (i32.const 7)) (local.get $n))
+		(i32.store8 (i32.add (local.get $ptr) (i32.const 14)) (local.get $n))
+		(i32.const 15)))`
+
+func TestActors(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	fn := deployWat(t, p, counterWat, FxABI{Fxs: []string{"count"}})
+	zero, err := p.addCBOR(ctx, []byte{0x00})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := p.AddFile(ctx, bytes.NewReader([]byte("tick")), &AddParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesis, err := p.SpawnActor(ctx, "counter", fn, "count", zero)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.SpawnActor(ctx, "counter", fn, "count", zero); err == nil {
+		t.Error("actors can't be spawned twice")
+	}
+	for _, id := range []string{"", "counter/x", ".."} {
+		if _, err := p.SpawnActor(ctx, id, fn, "count", zero); err == nil {
+			t.Errorf("actor id %q should be rejected", id)
+		}
+	}
+	if _, _, err := p.ActorHead(ctx, "unknown"); err == nil {
+		t.Error("expected an error for an unknown actor")
+	}
+
+	// Concurrent messages are processed one after the other, so none of
+	// them is lost.
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.Send(ctx, "counter", msg.Cid()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(p.actors.locks) != 0 {
+		t.Errorf("%d actor locks left", len(p.actors.locks))
+	}
+
+	// The history goes back to the genesis entry with one entry per
+	// message, each reply being the state it left.
+	head, c, err := p.ActorHead(ctx, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := n; i > 0; i-- {
+		if head.Reply == nil || *head.Reply != head.State {
+			t.Fatalf("entry %d: reply %v doesn't match state %s", i, head.Reply, head.State)
+		}
+		state, err := p.Get(ctx, head.State)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(state.RawData(), []byte{byte(i)}) {
+			t.Errorf("entry %d: unexpected state %x", i, state.RawData())
+		}
+		if head.Msg == nil || *head.Msg != msg.Cid() || head.Prev == nil {
+			t.Fatalf("entry %d: unexpected links %+v", i, head)
+		}
+		c = head.Prev
+		if head, err = p.GetActorEntry(ctx, *c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !c.Equals(*genesis) || head.State != zero || head.Prev != nil {
+		t.Errorf("expected the genesis entry, got %s: %+v", c, head)
+	}
+}
+
+func TestActorLocks(t *testing.T) {
+	a := &actorLocks{}
+	var wg sync.WaitGroup
+	running := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer a.lock("counter")()
+			running++
+			if running != 1 {
+				t.Error("messages to the same actor ran at the same time")
+			}
+			running--
+		}()
+	}
+	wg.Wait()
+	if len(a.locks) != 0 {
+		t.Errorf("%d locks left", len(a.locks))
+	}
+}
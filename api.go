@@ -0,0 +1,195 @@
+package ipfslite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// The API is the gateway plus the endpoints to manage the peer, for a daemon
+// to share its peer with local clients:
+//
+//	GET  /id                peer ID and addresses
+//	POST /connect           connects to {"Addr": "<multiaddr>"}
+//	POST /submit            submits a GatewayCall as a job and returns its ID
+//	GET  /jobs/<id>         state of a job
+//	GET  /jobs/<id>/wait    waits for a job to finish
+//	POST /jobs/<id>/cancel  cancels a job
+//
+// It must only be served locally, as anyone reaching it controls the peer.
+
+// DefaultRepo is where the daemon keeps its datastore and identity.
+const DefaultRepo = ".ipfs-lite"
+
+// DefaultAPIAddr is the Unix socket the daemon of a repo serves its API at.
+func DefaultAPIAddr(repo string) string {
+	return "unix:" + filepath.Join(repo, "api.sock")
+}
+
+// PeerInfo is the identity of a peer.
+type PeerInfo struct {
+	ID    peer.ID
+	Addrs []string
+}
+
+// API returns the HTTP handler of the local API.
+func (p *Peer) API() http.Handler {
+	mux := p.gatewayMux()
+	mux.HandleFunc("/id", p.apiID)
+	mux.HandleFunc("/connect", p.apiConnect)
+	mux.HandleFunc("/submit", p.apiSubmit)
+	mux.HandleFunc("/jobs/", p.apiJob)
+	return mux
+}
+
+// ServeAPI serves the API on addr until ctx is done. addr is either a TCP
+// address or unix:<path> for a Unix socket.
+func (p *Peer) ServeAPI(ctx context.Context, addr string) error {
+	l, err := listenAPI(addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: p.API()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	err = srv.Serve(l)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func listenAPI(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+	// Remove the socket left by a daemon that didn't stop cleanly.
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return nil, errors.New("API already served at " + addr)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+func (p *Peer) apiID(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	info, err := p.info()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (p *Peer) info() (*PeerInfo, error) {
+	if p.host == nil {
+		return nil, errors.New("peer has no libp2p host")
+	}
+	info := &PeerInfo{ID: p.host.ID()}
+	for _, a := range p.host.Addrs() {
+		info.Addrs = append(info.Addrs, a.String())
+	}
+	return info, nil
+}
+
+func (p *Peer) apiConnect(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	req := struct{ Addr string }{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	if err := p.connectAddr(req.Addr); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// connectAddr connects to the peer at a /p2p multiaddr.
+func (p *Peer) connectAddr(addr string) error {
+	maddr, err := ma.NewMultiaddr(addr)
+	if err != nil {
+		return badRequest(err)
+	}
+	info, err := peer.AddrInfoFromP2pAddr(maddr)
+	if err != nil {
+		return badRequest(err)
+	}
+	return p.ConnectPeer(*info)
+}
+
+func (p *Peer) apiSubmit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	call := GatewayCall{}
+	if err := json.NewDecoder(r.Body).Decode(&call); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	id, err := p.Submit(r.Context(), call.Fn, call.Fx, call.Args)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, struct{ ID string }{id})
+}
+
+// apiJob answers /jobs/<id>, /jobs/<id>/wait and /jobs/<id>/cancel.
+func (p *Peer) apiJob(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	id := parts[0]
+	action := ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+
+	var job *Job
+	var err error
+	switch action {
+	case "":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		job, err = p.Status(id)
+	case "wait":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		job, err = p.Wait(r.Context(), id)
+	case "cancel":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		if err = p.Cancel(id); err == nil {
+			job, err = p.Status(id)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,117 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+// serveAPI serves the API of p until ctx is done and returns a client once
+// it is up, and the channel getting the error ServeAPI returns.
+func serveAPI(t *testing.T, ctx context.Context, p *Peer) (*Client, chan error) {
+	t.Helper()
+	addr := "unix:" + filepath.Join(t.TempDir(), "api.sock")
+	served := make(chan error, 1)
+	go func() { served <- p.ServeAPI(ctx, addr) }()
+	c := NewClient(addr)
+	// Wait for the socket.
+	for i := 0; ; i++ {
+		_, err := c.Status(ctx, "unknown")
+		if err == ErrJobNotFound {
+			break
+		}
+		if i == 50 {
+			t.Fatalf("API not served: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c, served
+}
+
+func TestClient(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := dagPeer(t)
+	p.ctx = ctx
+	p.cfg.Workers = 0
+	if err := p.startJobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, served := serveAPI(t, ctx, p)
+
+	added, err := c.Add(ctx, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := c.Get(ctx, added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(b) != "hello" {
+		t.Errorf("expected hello, got %q", b)
+	}
+
+	fn, err := p.putABI(ctx, &FxABI{Fxs: []string{"fx"}, Bytecode: added})
+	if err != nil {
+		t.Fatal(err)
+	}
+	abi, err := c.ABI(ctx, *fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !abi.Bytecode.Equals(added) {
+		t.Errorf("expected bytecode %s, got %s", added, abi.Bytecode)
+	}
+
+	id, err := c.Submit(ctx, *fn, "fx", []cid.Cid{added})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job, err := c.Status(ctx, id); err != nil || job.State != JobQueued {
+		t.Errorf("job should be queued, got %v, %v", job, err)
+	}
+	if job, err := c.Cancel(ctx, id); err != nil || job.State != JobCanceled {
+		t.Errorf("job should be canceled, got %v, %v", job, err)
+	}
+
+	// The peer has no host.
+	var apiErr *APIError
+	if _, err := c.ID(ctx); !errors.As(err, &apiErr) || apiErr.Status != 500 {
+		t.Errorf("expected an internal error, got %v", err)
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientTrap(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := runtimePeer(t)
+	p.ctx = ctx
+	c, _ := serveAPI(t, ctx, p)
+
+	fn := deployWat(t, p, errorsWat, FxABI{Fxs: []string{"badlog"}})
+	in, err := c.Add(ctx, bytes.NewReader([]byte("input")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Traps raised by host functions keep their cause through the API.
+	var trap *TrapError
+	_, err = c.Call(ctx, fn, "badlog", []cid.Cid{in})
+	if !errors.As(err, &trap) || trap.Code != TrapHost || !strings.Contains(trap.Cause, "out of bounds") {
+		t.Errorf("expected a host trap with its cause, got %#v", err)
+	}
+}
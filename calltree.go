@@ -0,0 +1,139 @@
+package ipfslite
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/ipfs/go-cid"
+)
+
+type callTreeKey struct{}
+
+// callTree is the state shared by every call triggered from the same
+// top-level call, either directly or by functions calling other functions
+// through the host.
+//
+// wasmtime-go doesn't support fuel metering yet, so the execution budget of
+// the tree is bounded by the number of calls and a shared deadline instead.
+type callTree struct {
+	store *wasmtime.Store
+
+	maxDepth     int
+	maxCalls     int
+	maxRecursion int
+	calls        int
+	// Calls currently running, from the root to the innermost one.
+	stack []string
+	// Number of calls running for each function.
+	running map[string]int
+
+	// Error of the nested call that made the running function trap, if any.
+	nestedErr error
+	// Error of the host function that made the running function trap, if
+	// any.
+	hostErr error
+}
+
+// callTree returns the call tree the context belongs to, or starts a new one.
+// The returned function must be called once the caller is done.
+func (p *Peer) callTree(ctx context.Context) (context.Context, *callTree, func()) {
+	if tree, ok := ctx.Value(callTreeKey{}).(*callTree); ok {
+		return ctx, tree, func() {}
+	}
+
+	tree := &callTree{
+		store:        wasmtime.NewStore(p.engine),
+		maxDepth:     p.cfg.MaxCallDepth,
+		maxCalls:     p.cfg.MaxCalls,
+		maxRecursion: p.cfg.MaxRecursion,
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.CallTimeout)
+	ctx = context.WithValue(ctx, callTreeKey{}, tree)
+
+	// Stop any running function once the deadline is reached.
+	handle, err := tree.store.InterruptHandle()
+	if err != nil {
+		logger.Error(err)
+	} else {
+		go func() {
+			<-ctx.Done()
+			handle.Interrupt()
+		}()
+	}
+	return ctx, tree, cancel
+}
+
+// callKey identifies a call by the function, fx and arguments it is called
+// with.
+func callKey(fnCid cid.Cid, fx string, args []cid.Cid) string {
+	s := make([]string, 0, len(args))
+	for _, a := range args {
+		s = append(s, a.String())
+	}
+	return fnCid.String() + "/" + fx + "/" + strings.Join(s, ",")
+}
+
+// enter registers a new call in the tree, checking that it doesn't exceed
+// the limits of the tree and that it isn't already running further up the
+// stack, which would never end. Functions calling each other with changing
+// arguments are also taken as a cycle once they are running more than
+// maxRecursion times.
+func (t *callTree) enter(fnCid cid.Cid, fx string, args []cid.Cid) error {
+	key := callKey(fnCid, fx, args)
+	if len(t.stack) >= t.maxDepth {
+		return &LimitError{Limit: LimitCallDepth, Max: strconv.Itoa(t.maxDepth)}
+	}
+	if t.calls >= t.maxCalls {
+		return &LimitError{Limit: LimitCalls, Max: strconv.Itoa(t.maxCalls)}
+	}
+	for _, k := range t.stack {
+		if k == key {
+			return &CycleError{Call: key}
+		}
+	}
+	fnKey := fnCid.String() + "/" + fx
+	if t.maxRecursion > 0 && t.running[fnKey] >= t.maxRecursion {
+		return &CycleError{Call: key}
+	}
+	if t.running == nil {
+		t.running = make(map[string]int)
+	}
+	t.calls++
+	t.stack = append(t.stack, key)
+	t.running[fnKey]++
+	return nil
+}
+
+// leave pops the innermost call.
+func (t *callTree) leave() {
+	key := t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+	fnKey := key[:strings.LastIndex(key, "/")]
+	if t.running[fnKey]--; t.running[fnKey] == 0 {
+		delete(t.running, fnKey)
+	}
+}
+
+// takeError returns the error that made a function of the tree trap if it
+// was raised by the host, and forgets it.
+func (t *callTree) takeError() (nested, host error) {
+	nested, host = t.nestedErr, t.hostErr
+	t.nestedErr, t.hostErr = nil, nil
+	return nested, host
+}
+
+// fail returns the trap raised to stop the guest with an error that
+// callError returns as it is, like the errors of nested calls.
+func (t *callTree) fail(err error) *wasmtime.Trap {
+	t.nestedErr = err
+	return wasmtime.NewTrap(t.store, err.Error())
+}
+
+// trap returns the trap raised when a host function fails, and keeps the
+// error so callError can return it.
+func (t *callTree) trap(err error) *wasmtime.Trap {
+	t.hostErr = err
+	return wasmtime.NewTrap(t.store, err.Error())
+}
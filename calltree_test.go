@@ -0,0 +1,140 @@
+package ipfslite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+func TestCallTreeLimits(t *testing.T) {
+	fn, err := cid.Decode("bafybeigft6kodyhajn5m2fx6raevfcj6umdob2jiuntufbvttwpygz767q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := &callTree{maxDepth: 2, maxCalls: 3}
+	if err := tree.enter(fn, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	var cycle *CycleError
+	if err := tree.enter(fn, "a", nil); !errors.As(err, &cycle) {
+		t.Errorf("cycle should have been detected, got %v", err)
+	}
+	if err := tree.enter(fn, "b", nil); err != nil {
+		t.Fatal(err)
+	}
+	var limit *LimitError
+	if err := tree.enter(fn, "c", nil); !errors.As(err, &limit) || limit.Limit != LimitCallDepth {
+		t.Errorf("maximum depth should have been exceeded, got %v", err)
+	}
+
+	tree.leave()
+	if err := tree.enter(fn, "c", nil); err != nil {
+		t.Fatal(err)
+	}
+	tree.leave()
+	if err := tree.enter(fn, "d", nil); !errors.As(err, &limit) || limit.Limit != LimitCalls {
+		t.Errorf("maximum number of calls should have been exceeded, got %v", err)
+	}
+}
+
+func TestCallTreeRecursion(t *testing.T) {
+	fn, err := cid.Decode("bafybeigft6kodyhajn5m2fx6raevfcj6umdob2jiuntufbvttwpygz767q")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree := &callTree{maxDepth: 16, maxCalls: 16, maxRecursion: 2}
+	if err := tree.enter(fn, "a", []cid.Cid{fn}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.enter(fn, "b", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.enter(fn, "a", nil); err != nil {
+		t.Fatal(err)
+	}
+	var cycle *CycleError
+	if err := tree.enter(fn, "a", []cid.Cid{fn, fn}); !errors.As(err, &cycle) {
+		t.Errorf("recursion should have been stopped, got %v", err)
+	}
+	tree.leave()
+	tree.leave()
+	if err := tree.enter(fn, "a", []cid.Cid{fn, fn}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// selfCallWat exports self and deeper, which call themselves with ipfs.call.
+// Their argument is an identity CID holding the CID of the function in
+// base16, so they can pass it on. deeper appends an x to it on every call.
+const selfCallWat = `(module
+	(import "ipfs" "call" (func $call (param i32 i32 i32 i32 i32 i32 i32 i32) (result i32)))
+	(memory (export "memory") 1)
+	(global $heap (mut i32) (i32.const 1024))
+	(data (i32.const 0) "0123456789abcdef")
+	(data (i32.const 16) "f015500")
+	(data (i32.const 32) "self")
+	(data (i32.const 40) "deeper")
+	(func $bump (param $size i32) (result i32)
+		(local $ptr i32)
+		(local.set $ptr (global.get $heap))
+		(global.set $heap (i32.add (global.get $heap) (local.get $size)))
+		(local.get $ptr))
+	(func (export "alloc") (param $size i32) (result i32)
+		(call $bump (local.get $size)))
+	(func $hex (param $dst i32) (param $b i32)
+		(i32.store8 (local.get $dst) (i32.load8_u (i32.shr_u (local.get $b) (i32.const 4))))
+		(i32.store8 (i32.add (local.get $dst) (i32.const 1)) (i32.load8_u (i32.and (local.get $b) (i32.const 15)))))
+	;; recurse calls fx with the CID holding the n bytes at ptr.
+	(func $recurse (param $ptr i32) (param $n i32) (param $fx i32) (param $fxLen i32) (result i32)
+		(local $s i32)
+		(local $i i32)
+		(local.set $s (call $bump (i32.add (i32.const 9) (i32.shl (local.get $n) (i32.const 1)))))
+		(i64.store (local.get $s) (i64.load (i32.const 16)))
+		(call $hex (i32.add (local.get $s) (i32.const 7)) (local.get $n))
+		(block $done
+			(loop $next
+				(br_if $done (i32.eq (local.get $i) (local.get $n)))
+				(call $hex
+					(i32.add (i32.add (local.get $s) (i32.const 9)) (i32.shl (local.get $i) (i32.const 1)))
+					(i32.load8_u (i32.add (local.get $ptr) (local.get $i))))
+				(local.set $i (i32.add (local.get $i) (i32.const 1)))
+				(br $next)))
+		(drop (call $call
+			(local.get $ptr) (i32.const 59)
+			(local.get $fx) (local.get $fxLen)
+			(local.get $s) (i32.add (i32.const 9) (i32.shl (local.get $n) (i32.const 1)))
+			(i32.const 512) (i32.const 128)))
+		(i32.const 0))
+	(func (export "self") (param $ptr i32) (param $len i32) (result i32)
+		(call $recurse (local.get $ptr) (local.get $len) (i32.const 32) (i32.const 4)))
+	(func (export "deeper") (param $ptr i32) (param $len i32) (result i32)
+		(i32.store8 (i32.add (local.get $ptr) (local.get $len)) (i32.const 120))
+		(call $recurse (local.get $ptr) (i32.add (local.get $len) (i32.const 1)) (i32.const 40) (i32.const 6))))`
+
+func TestSelfCall(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	fn := deployWat(t, p, selfCallWat, FxABI{Fxs: []string{"self", "deeper"}})
+	if len(fn.String()) != 59 {
+		t.Fatalf("unexpected CID length of %s", fn)
+	}
+	mh, err := multihash.Sum([]byte(fn.String()), multihash.IDENTITY, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	arg := cid.NewCidV1(cid.Raw, mh)
+
+	// The error of the nested call that failed reaches the caller.
+	var cycle *CycleError
+	if _, err := p.Call(ctx, fn, "self", []cid.Cid{arg}); !errors.As(err, &cycle) {
+		t.Errorf("expected a cycle, got %v", err)
+	}
+	if _, err := p.Call(ctx, fn, "deeper", []cid.Cid{arg}); !errors.As(err, &cycle) {
+		t.Errorf("expected recursion to be stopped as a cycle, got %v", err)
+	}
+}
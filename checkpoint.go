@@ -0,0 +1,315 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// wasmPageSize is the size of a page of WASM linear memory.
+const wasmPageSize = 65536
+
+func init() {
+	cbornode.RegisterCborType(Checkpoint{})
+	cbornode.RegisterCborType(GlobalSnapshot{})
+	cbornode.RegisterCborType(Region{})
+}
+
+// Checkpoint is a snapshot of a resumable call that can be resumed by any
+// peer with Resume.
+//
+// Resumable functions are driven by the host in steps. The host first calls
+// fx with the inputs following the calling convention of the ABI so it can
+// set up its state. Then it calls fx_step until it returns 0, and finally
+// fx_result to get the output, which is returned following the calling
+// convention too. Every step returns to the host so no stack needs to be
+// saved: a checkpoint only holds the linear memory and the mutable exported
+// globals of the module. Globals that are not exported are not captured.
+type Checkpoint struct {
+	Fn      cid.Cid
+	Fx      string
+	Args    []cid.Cid
+	Memory  cid.Cid          // UnixFS file with the contents of linear memory.
+	Globals []GlobalSnapshot // Values of the mutable exported globals.
+	Regions []Region         // Input regions not released yet.
+	Steps   uint64           // Steps run so far.
+}
+
+// GlobalSnapshot stores the value of a global as raw bits.
+type GlobalSnapshot struct {
+	Name string
+	Kind string
+	Bits uint64
+}
+
+// Region of guest memory.
+type Region struct {
+	Ptr  int32
+	Size int32
+}
+
+// ResumableResult is the result of running a resumable call. Output is set
+// when the call finished. Otherwise Checkpoint points to the snapshot from
+// which it can be resumed.
+type ResumableResult struct {
+	Output     *cid.Cid
+	Checkpoint *cid.Cid
+}
+
+// CallResumable starts a resumable call. It runs until the function finishes,
+// the number of steps reaches Config.MaxSteps or the context is cancelled, in
+// which case a checkpoint is taken. Cancelling the context doesn't interrupt
+// the running step, the checkpoint is taken once it returns. A step still
+// running when Config.CallTimeout is reached is interrupted though, and the
+// progress since the last checkpoint is lost.
+func (p *Peer) CallResumable(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*ResumableResult, error) {
+	runCtx, tree, done := p.callTree(detach(ctx))
+	defer done()
+
+	abi, err := p.runnableABI(runCtx, fnCid)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([][]byte, 0, len(argsCid))
+	for _, c := range argsCid {
+		d, err := p.fetch(runCtx, c)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, d)
+	}
+
+	instance, g, err := p.instantiate(runCtx, tree, abi)
+	if err != nil {
+		return nil, err
+	}
+	fx, err := exportedFunc(instance, fxName)
+	if err != nil {
+		return nil, err
+	}
+	args, err := g.pushArgs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := g.call(fx, args...); err != nil {
+		return nil, p.callError(runCtx, err)
+	}
+
+	cp := &Checkpoint{Fn: fnCid, Fx: fxName, Args: argsCid}
+	return p.runSteps(runCtx, ctx, instance, g, cp)
+}
+
+// Resume a resumable call from a checkpoint. Like CallResumable, it takes a
+// new checkpoint if it runs out of steps or the context is cancelled.
+func (p *Peer) Resume(ctx context.Context, checkpointCid cid.Cid) (*ResumableResult, error) {
+	runCtx, tree, done := p.callTree(detach(ctx))
+	defer done()
+
+	cp, err := p.GetCheckpoint(runCtx, checkpointCid)
+	if err != nil {
+		return nil, err
+	}
+	abi, err := p.runnableABI(runCtx, cp.Fn)
+	if err != nil {
+		return nil, err
+	}
+	instance, g, err := p.instantiate(runCtx, tree, abi)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.restore(runCtx, instance, g, cp); err != nil {
+		return nil, err
+	}
+	return p.runSteps(runCtx, ctx, instance, g, cp)
+}
+
+// detachedContext keeps the values of a context without its cancellation.
+type detachedContext struct {
+	context.Context
+}
+
+// detach returns a context with the values of ctx that is never cancelled.
+func detach(ctx context.Context) context.Context {
+	return detachedContext{ctx}
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// GetCheckpoint fetches and decodes a checkpoint.
+func (p *Peer) GetCheckpoint(ctx context.Context, c cid.Cid) (*Checkpoint, error) {
+	n, err := p.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	cp := Checkpoint{}
+	if err := cbornode.DecodeInto(n.RawData(), &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// runSteps steps the function until it finishes, it runs out of steps or
+// time, or the caller context is cancelled. ctx is the context of the call
+// tree.
+func (p *Peer) runSteps(ctx, caller context.Context, instance *wasmtime.Instance, g *guest, cp *Checkpoint) (*ResumableResult, error) {
+	step, err := exportedFunc(instance, cp.Fx+"_step")
+	if err != nil {
+		return nil, err
+	}
+	result, err := exportedFunc(instance, cp.Fx+"_result")
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; ; i++ {
+		// Stop before the deadline interrupts the next step.
+		if i >= p.cfg.MaxSteps || caller.Err() != nil || ctx.Err() != nil {
+			c, err := p.checkpoint(ctx, instance, g, cp)
+			if err != nil {
+				return nil, err
+			}
+			return &ResumableResult{Checkpoint: c}, nil
+		}
+		ret, err := g.call(step)
+		if err != nil {
+			return nil, p.callError(ctx, err)
+		}
+		cp.Steps++
+		status, ok := ret.(int32)
+		if !ok {
+			return nil, fmt.Errorf("%s_step returned %T instead of i32", cp.Fx, ret)
+		}
+		if status == 0 {
+			break
+		}
+	}
+
+	ret, err := g.call(result)
+	if err != nil {
+		return nil, p.callError(ctx, err)
+	}
+	out, err := g.output(ret)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.free(); err != nil {
+		return nil, err
+	}
+	output, err := p.AddFile(ctx, bytes.NewReader(out), &AddParams{})
+	if err != nil {
+		return nil, err
+	}
+	c := output.Cid()
+	return &ResumableResult{Output: &c}, nil
+}
+
+// checkpoint snapshots linear memory and the mutable exported globals.
+func (p *Peer) checkpoint(ctx context.Context, instance *wasmtime.Instance, g *guest, cp *Checkpoint) (*cid.Cid, error) {
+	mem, err := p.AddFile(ctx, bytes.NewReader(g.memory.UnsafeData()), &AddParams{})
+	if err != nil {
+		return nil, err
+	}
+	cp.Memory = mem.Cid()
+
+	cp.Globals = nil
+	for _, name := range mutableGlobals(instance) {
+		v := instance.GetExport(name).Global().Get()
+		s := GlobalSnapshot{Name: name, Kind: v.Kind().String()}
+		switch v.Kind() {
+		case wasmtime.KindI32:
+			s.Bits = uint64(uint32(v.I32()))
+		case wasmtime.KindI64:
+			s.Bits = uint64(v.I64())
+		case wasmtime.KindF32:
+			s.Bits = uint64(math.Float32bits(v.F32()))
+		case wasmtime.KindF64:
+			s.Bits = math.Float64bits(v.F64())
+		default:
+			return nil, fmt.Errorf("can't snapshot global %s of type %s", name, v.Kind())
+		}
+		cp.Globals = append(cp.Globals, s)
+	}
+
+	cp.Regions = nil
+	for _, r := range g.allocated {
+		cp.Regions = append(cp.Regions, Region{Ptr: r.ptr, Size: r.size})
+	}
+
+	n, err := cbornode.WrapObject(cp, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Add(ctx, n); err != nil {
+		return nil, err
+	}
+	c := n.Cid()
+	return &c, nil
+}
+
+// restore loads a checkpoint into a fresh instance of the module.
+func (p *Peer) restore(ctx context.Context, instance *wasmtime.Instance, g *guest, cp *Checkpoint) error {
+	data, err := p.fetch(ctx, cp.Memory)
+	if err != nil {
+		return err
+	}
+	pages := uint(len(data) / wasmPageSize)
+	if current := uint(g.memory.Size()); pages > current {
+		if !g.memory.Grow(pages - current) {
+			return fmt.Errorf("couldn't grow memory to %d pages", pages)
+		}
+	}
+	copy(g.memory.UnsafeData(), data)
+
+	for _, s := range cp.Globals {
+		ext := instance.GetExport(s.Name)
+		if ext == nil || ext.Global() == nil {
+			return &ExportError{Name: s.Name, Kind: "global"}
+		}
+		var v wasmtime.Val
+		switch s.Kind {
+		case wasmtime.KindI32.String():
+			v = wasmtime.ValI32(int32(uint32(s.Bits)))
+		case wasmtime.KindI64.String():
+			v = wasmtime.ValI64(int64(s.Bits))
+		case wasmtime.KindF32.String():
+			v = wasmtime.ValF32(math.Float32frombits(uint32(s.Bits)))
+		case wasmtime.KindF64.String():
+			v = wasmtime.ValF64(math.Float64frombits(s.Bits))
+		default:
+			return fmt.Errorf("can't restore global %s of type %s", s.Name, s.Kind)
+		}
+		if err := ext.Global().Set(v); err != nil {
+			return err
+		}
+	}
+
+	g.allocated = nil
+	for _, r := range cp.Regions {
+		// Inputs were pinned when allocated, and the pins are part of the
+		// memory restored.
+		g.allocated = append(g.allocated, region{ptr: r.Ptr, size: r.Size, pinned: g.pin != nil})
+	}
+	return nil
+}
+
+// mutableGlobals returns the names of the mutable globals exported by an
+// instance.
+func mutableGlobals(instance *wasmtime.Instance) []string {
+	names := []string{}
+	for _, e := range instance.Type().Exports() {
+		gt := e.Type().GlobalType()
+		if gt != nil && gt.Mutable() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
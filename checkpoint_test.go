@@ -0,0 +1,121 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// hashWat exports a resumable hash function taking 5 steps per byte of its
+// input. The hash is kept in memory and the progress in exported globals, so
+// both need to be restored to resume it.
+const hashWat = `(module
+	(memory (export "memory") 1)
+	(global $heap (export "heap") (mut i32) (i32.const 1024))
+	(global $buf (export "buf") (mut i32) (i32.const 0))
+	(global $i (export "i") (mut i32) (i32.const 0))
+	(global $n (export "n") (mut i32) (i32.const 0))
+	(func (export "alloc") (param $size i32) (result i32)
+		(local $ptr i32)
+		(local.set $ptr (global.get $heap))
+		(global.set $heap (i32.add (global.get $heap) (local.get $size)))
+		(local.get $ptr))
+	(func (export "hash") (param $ptr i32) (param $len i32) (result i32)
+		(global.set $buf (local.get $ptr))
+		(global.set $n (i32.mul (local.get $len) (i32.const 5)))
+		(i32.const 0))
+	(func (export "hash_step") (result i32)
+		(i32.store (i32.const 64)
+			(i32.add
+				(i32.mul (i32.load (i32.const 64)) (i32.const 31))
+				(i32.load8_u (i32.add (global.get $buf) (i32.div_u (global.get $i) (i32.const 5))))))
+		(global.set $i (i32.add (global.get $i) (i32.const 1)))
+		(i32.lt_u (global.get $i) (global.get $n)))
+	(func (export "hash_result") (result i32)
+		(i32.store (global.get $buf) (i32.load (i32.const 64)))
+		(i32.const 4)))`
+
+func TestCallResumable(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	fn := deployWat(t, p, hashWat, FxABI{Fxs: []string{"hash"}})
+	in, err := p.AddFile(ctx, bytes.NewReader([]byte("hello")), &AddParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []cid.Cid{in.Cid()}
+
+	var h uint32
+	for i := 0; i < 25; i++ {
+		h = h*31 + uint32("hello"[i/5])
+	}
+	expected := make([]byte, 4)
+	binary.LittleEndian.PutUint32(expected, h)
+	output := func(res *ResumableResult) []byte {
+		t.Helper()
+		if res.Output == nil {
+			t.Fatal("the call didn't finish")
+		}
+		r, err := p.GetFile(ctx, *res.Output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	res, err := p.CallResumable(ctx, fn, "hash", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := output(res); !bytes.Equal(out, expected) {
+		t.Fatalf("expected %x, got %x", expected, out)
+	}
+
+	// Running out of steps twice takes two checkpoints.
+	p.cfg.MaxSteps = 10
+	res, err = p.CallResumable(ctx, fn, "hash", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for steps := uint64(10); res.Checkpoint != nil; steps += 10 {
+		cp, err := p.GetCheckpoint(ctx, *res.Checkpoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cp.Steps != steps {
+			t.Errorf("expected a checkpoint after %d steps, got %d", steps, cp.Steps)
+		}
+		if res, err = p.Resume(ctx, *res.Checkpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out := output(res); !bytes.Equal(out, expected) {
+		t.Errorf("resumed call returned %x instead of %x", out, expected)
+	}
+
+	// Cancelled calls are checkpointed too.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	res, err = p.CallResumable(cancelled, fn, "hash", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Checkpoint == nil {
+		t.Fatal("expected a checkpoint")
+	}
+	p.cfg.MaxSteps = 1000
+	if res, err = p.Resume(ctx, *res.Checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	if out := output(res); !bytes.Equal(out, expected) {
+		t.Errorf("resumed call returned %x instead of %x", out, expected)
+	}
+}
@@ -0,0 +1,208 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Client talks to the API of a peer run by a daemon, so scripts and
+// terminals can share the same peer.
+type Client struct {
+	base string
+	http *http.Client
+}
+
+// APIError is an error returned by the API. Traps are returned as a
+// TrapError and unknown jobs as ErrJobNotFound instead.
+type APIError struct {
+	Status  int
+	Kind    string
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// NewClient returns a client of the API served at addr, either a TCP address
+// or unix:<path> for a Unix socket.
+func NewClient(addr string) *Client {
+	path := strings.TrimPrefix(addr, "unix:")
+	if path == addr {
+		return &Client{base: "http://" + addr, http: &http.Client{}}
+	}
+	dialer := &net.Dialer{}
+	return &Client{
+		base: "http://unix",
+		http: &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}},
+	}
+}
+
+// do sends a request and decodes the JSON response into out, if not nil.
+func (c *Client) do(ctx context.Context, method, path, contentType string, body io.Reader, out interface{}) error {
+	res, err := c.request(ctx, method, path, contentType, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// request sends a request and turns failed responses into errors.
+func (c *Client) request(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 300 {
+		return res, nil
+	}
+
+	defer res.Body.Close()
+	e := GatewayError{}
+	if err := json.NewDecoder(res.Body).Decode(&e); err != nil {
+		return nil, fmt.Errorf("%s %s: %s", method, path, res.Status)
+	}
+	switch {
+	case e.Trap != nil:
+		return nil, e.Trap
+	case e.Kind == "job":
+		return nil, ErrJobNotFound
+	}
+	return nil, &APIError{Status: res.StatusCode, Kind: e.Kind, Message: e.Error}
+}
+
+func jsonBody(v interface{}) (io.Reader, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(b), nil
+}
+
+// ID returns the identity of the peer.
+func (c *Client) ID(ctx context.Context) (*PeerInfo, error) {
+	info := &PeerInfo{}
+	return info, c.do(ctx, http.MethodGet, "/id", "", nil, info)
+}
+
+// Connect connects the peer to another one.
+func (c *Client) Connect(ctx context.Context, addr string) error {
+	body, err := jsonBody(struct{ Addr string }{addr})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPost, "/connect", "application/json", body, nil)
+}
+
+// Add adds a file.
+func (c *Client) Add(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	out := struct{ Cid cid.Cid }{}
+	err := c.do(ctx, http.MethodPost, "/add", "application/octet-stream", r, &out)
+	return out.Cid, err
+}
+
+// Get returns the content of a file.
+func (c *Client) Get(ctx context.Context, f cid.Cid) (io.ReadCloser, error) {
+	res, err := c.request(ctx, http.MethodGet, "/ipfs/"+f.String(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// ABI returns the ABI of a function.
+func (c *Client) ABI(ctx context.Context, fn cid.Cid) (*FxABI, error) {
+	abi := &FxABI{}
+	return abi, c.do(ctx, http.MethodGet, "/abi/"+fn.String(), "", nil, abi)
+}
+
+// Deploy deploys a function like Peer.DeployABI.
+func (c *Client) Deploy(ctx context.Context, abi FxABI, bytecode []byte) (cid.Cid, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("bytecode", "bytecode.wasm")
+	if err != nil {
+		return cid.Undef, err
+	}
+	if _, err := fw.Write(bytecode); err != nil {
+		return cid.Undef, err
+	}
+	b, err := json.Marshal(abi)
+	if err != nil {
+		return cid.Undef, err
+	}
+	if err := mw.WriteField("abi", string(b)); err != nil {
+		return cid.Undef, err
+	}
+	if err := mw.Close(); err != nil {
+		return cid.Undef, err
+	}
+
+	out := struct{ Cid cid.Cid }{}
+	err = c.do(ctx, http.MethodPost, "/deploy", mw.FormDataContentType(), &body, &out)
+	return out.Cid, err
+}
+
+// Call calls a function.
+func (c *Client) Call(ctx context.Context, fn cid.Cid, fx string, args []cid.Cid) (*CallResult, error) {
+	body, err := jsonBody(GatewayCall{Fn: fn, Fx: fx, Args: args})
+	if err != nil {
+		return nil, err
+	}
+	res := &CallResult{}
+	return res, c.do(ctx, http.MethodPost, "/call", "application/json", body, res)
+}
+
+// Submit queues a call to run in the background and returns the ID of the
+// job.
+func (c *Client) Submit(ctx context.Context, fn cid.Cid, fx string, args []cid.Cid) (string, error) {
+	body, err := jsonBody(GatewayCall{Fn: fn, Fx: fx, Args: args})
+	if err != nil {
+		return "", err
+	}
+	out := struct{ ID string }{}
+	err = c.do(ctx, http.MethodPost, "/submit", "application/json", body, &out)
+	return out.ID, err
+}
+
+// Status returns the current state of a job.
+func (c *Client) Status(ctx context.Context, id string) (*Job, error) {
+	job := &Job{}
+	return job, c.do(ctx, http.MethodGet, "/jobs/"+id, "", nil, job)
+}
+
+// Wait blocks until a job finishes and returns it.
+func (c *Client) Wait(ctx context.Context, id string) (*Job, error) {
+	job := &Job{}
+	return job, c.do(ctx, http.MethodGet, "/jobs/"+id+"/wait", "", nil, job)
+}
+
+// Cancel stops a job and returns it.
+func (c *Client) Cancel(ctx context.Context, id string) (*Job, error) {
+	job := &Job{}
+	return job, c.do(ctx, http.MethodPost, "/jobs/"+id+"/cancel", "", nil, job)
+}
@@ -0,0 +1,569 @@
+package ipfslite
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// CLI runs the commands of the command line tools, like
+//
+//	call <fnCid> --fx map --arg <cid> --arg <cid>
+//
+// either on a local peer or on the peer of a daemon through its API.
+// Commands print their result as text, or as JSON when JSON is set.
+type CLI struct {
+	node cliNode
+	// peer is nil when using a daemon.
+	peer *Peer
+	out  io.Writer
+	// closer closes the peer opened by OpenCLI.
+	closer io.Closer
+
+	// JSON prints results and errors as JSON.
+	JSON bool
+	// Background runs the commands serving the peer, like work and gateway,
+	// in the background instead of until the context is done, e.g. for the
+	// prompt of the CLI.
+	Background bool
+}
+
+// cliNode is what commands need from a peer, either local or through the API.
+type cliNode interface {
+	ID(ctx context.Context) (*PeerInfo, error)
+	Connect(ctx context.Context, addr string) error
+	Add(ctx context.Context, r io.Reader) (cid.Cid, error)
+	Get(ctx context.Context, f cid.Cid) (io.ReadCloser, error)
+	ABI(ctx context.Context, fn cid.Cid) (*FxABI, error)
+	Deploy(ctx context.Context, abi FxABI, bytecode []byte) (cid.Cid, error)
+	Call(ctx context.Context, fn cid.Cid, fx string, args []cid.Cid) (*CallResult, error)
+	Submit(ctx context.Context, fn cid.Cid, fx string, args []cid.Cid) (string, error)
+	Status(ctx context.Context, id string) (*Job, error)
+	Wait(ctx context.Context, id string) (*Job, error)
+	Cancel(ctx context.Context, id string) (*Job, error)
+}
+
+// NewCLI returns a CLI running commands on a local peer and printing to out.
+func NewCLI(p *Peer, out io.Writer) *CLI {
+	return &CLI{node: localNode{p}, peer: p, out: out}
+}
+
+// NewClientCLI returns a CLI running commands on the peer of a daemon and
+// printing to out. Commands needing a local peer fail.
+func NewClientCLI(c *Client, out io.Writer) *CLI {
+	return &CLI{node: c, out: out}
+}
+
+// UsesDaemon tells whether commands run on the peer of a daemon.
+func (c *CLI) UsesDaemon() bool {
+	return c.peer == nil
+}
+
+// Close closes the peer opened by OpenCLI, if any.
+func (c *CLI) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// Run runs a command given as its name followed by its arguments and flags,
+// and prints its result or error.
+func (c *CLI) Run(ctx context.Context, args []string) error {
+	err := c.exec(ctx, args)
+	if err != nil {
+		c.printError(args, err)
+	}
+	return err
+}
+
+// RunLine splits a line like a shell and runs it. Empty lines and lines
+// starting with # are skipped.
+func (c *CLI) RunLine(ctx context.Context, line string) error {
+	args, err := SplitArgs(line)
+	if err != nil {
+		err = badRequest(err)
+		c.printError(nil, err)
+		return err
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return c.Run(ctx, args)
+}
+
+// RunScript runs a file of commands, one per line, stopping at the first one
+// failing.
+func (c *CLI) RunScript(ctx context.Context, path string) error {
+	return c.Run(ctx, []string{"script", path})
+}
+
+// runScript runs the lines of a script, returning the error of the first
+// failing one with its line number. A line like
+//
+//	fn = deploy ./fn.wasm --fx map
+//
+// stores the CID printed by the command in fn, and later lines get it back
+// in arguments written $fn.
+func (c *CLI) runScript(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	vars := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		args, err := SplitArgs(scanner.Text())
+		if err == nil && len(args) == 0 {
+			continue
+		}
+		if err == nil {
+			if !c.JSON {
+				fmt.Fprintln(c.out, ">>", scanner.Text())
+			}
+			if err = c.runScriptLine(ctx, vars, args); err == nil {
+				continue
+			}
+		}
+		return fmt.Errorf("%s:%d: %w", path, n, err)
+	}
+	return scanner.Err()
+}
+
+// runScriptLine runs a line of a script with its variables.
+func (c *CLI) runScriptLine(ctx context.Context, vars map[string]string, args []string) error {
+	name := ""
+	if len(args) > 2 && args[1] == "=" {
+		name, args = args[0], args[2:]
+	}
+	for i, arg := range args {
+		if !strings.HasPrefix(arg, "$") {
+			continue
+		}
+		v, ok := vars[arg[1:]]
+		if !ok {
+			return badRequest(fmt.Errorf("undefined variable %s", arg))
+		}
+		args[i] = v
+	}
+	if name == "" {
+		return c.exec(ctx, args)
+	}
+
+	defer func(json bool) { c.JSON = json }(c.JSON)
+	res, err := c.run(ctx, args)
+	if err != nil {
+		return err
+	}
+	r, ok := res.(cidResult)
+	if !ok {
+		return badRequest(fmt.Errorf("%s doesn't print a CID to store in %s", args[0], name))
+	}
+	vars[name] = r.Cid.String()
+	c.print(res)
+	return nil
+}
+
+// SplitArgs splits a command line into words like a shell. Words are
+// separated by spaces, unless in single or double quotes, and backslashes
+// escape the next character outside of single quotes. Lines starting with #
+// are comments.
+func SplitArgs(line string) ([]string, error) {
+	args := []string{}
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range strings.TrimSpace(line) {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '#' && !inWord && len(args) == 0:
+			return args, nil
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("line ends with a backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
+
+// command is a subcommand of the CLI.
+type command struct {
+	name string
+	// args names the positional arguments, e.g. "<fnCid> <inputCid>".
+	args  string
+	nargs int
+	help  string
+	// local is set for commands needing a local peer, which aren't available
+	// through the API of a daemon.
+	local bool
+	// flags defines the flags of the command and returns the function
+	// running it.
+	flags func(fs *flag.FlagSet) runFunc
+}
+
+// runFunc runs a command with its positional arguments, returning the result
+// to print.
+type runFunc func(ctx context.Context, c *CLI, args []string) (interface{}, error)
+
+// noFlags is for commands without flags.
+func noFlags(run runFunc) func(*flag.FlagSet) runFunc {
+	return func(*flag.FlagSet) runFunc { return run }
+}
+
+func (cmd *command) usage() string {
+	u := cmd.name
+	if cmd.args != "" {
+		u += " " + cmd.args
+	}
+	if fs, _ := cmd.flagSet(); countFlags(fs) > 0 {
+		u += " [flags]"
+	}
+	return u
+}
+
+// flagSet defines the flags of the command and returns the function running
+// it.
+func (cmd *command) flagSet() (*flag.FlagSet, runFunc) {
+	fs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs, cmd.flags(fs)
+}
+
+func countFlags(fs *flag.FlagSet) int {
+	n := 0
+	fs.VisitAll(func(*flag.Flag) { n++ })
+	return n
+}
+
+func lookupCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// exec runs a command and prints its result.
+func (c *CLI) exec(ctx context.Context, args []string) error {
+	defer func(json bool) { c.JSON = json }(c.JSON)
+	res, err := c.run(ctx, args)
+	if err != nil {
+		return err
+	}
+	c.print(res)
+	return nil
+}
+
+// run runs a command and returns its result without printing it. The --json
+// flag of the command sets JSON, which the caller restores.
+func (c *CLI) run(ctx context.Context, args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, badRequest(errors.New("no command given"))
+	}
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		return nil, badRequest(fmt.Errorf("unknown command %q, see help", args[0]))
+	}
+
+	fs, run := cmd.flagSet()
+	fs.BoolVar(&c.JSON, "json", c.JSON, "print the result as JSON")
+	pos, err := parseArgs(fs, args[1:])
+	if err == flag.ErrHelp {
+		return commandHelp(cmd), nil
+	}
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	if cmd.nargs >= 0 && len(pos) != cmd.nargs {
+		return nil, badRequest(errors.New("wrong number of arguments"))
+	}
+	if cmd.local && c.peer == nil {
+		return nil, fmt.Errorf("%s needs a local peer and isn't available through the daemon", cmd.name)
+	}
+	return run(ctx, c, pos)
+}
+
+// parseArgs parses flags anywhere among the arguments and returns the
+// positional ones. Arguments after -- are never parsed as flags.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	pos := []string{}
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return pos, nil
+		}
+		// Parse stops at the first positional argument, or after --.
+		if n := len(args) - len(rest); n > 0 && args[n-1] == "--" {
+			return append(pos, rest...), nil
+		}
+		pos = append(pos, rest[0])
+		args = rest[1:]
+	}
+}
+
+// cidList is a flag taking a CID each time it's given, e.g. --arg.
+type cidList []cid.Cid
+
+func (l *cidList) String() string {
+	return fmt.Sprint([]cid.Cid(*l))
+}
+
+func (l *cidList) Set(s string) error {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, c)
+	return nil
+}
+
+// stringList is a flag taking a value each time it's given, e.g. --fx.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// parseCid parses a CID given as an argument.
+func parseCid(s string) (cid.Cid, error) {
+	c, err := cid.Decode(s)
+	if err != nil {
+		return cid.Undef, badRequest(fmt.Errorf("invalid CID %q: %s", s, err))
+	}
+	return c, nil
+}
+
+// required checks that a flag was given.
+func required(name, value string) error {
+	if value == "" {
+		return badRequest(fmt.Errorf("--%s is required", name))
+	}
+	return nil
+}
+
+// cidResult is a CID printed after a label.
+type cidResult struct {
+	label string
+	Cid   cid.Cid
+}
+
+func (r cidResult) String() string {
+	return r.label + ": " + r.Cid.String()
+}
+
+// message is a result only telling that the command succeeded.
+type message string
+
+func (m message) String() string {
+	return string(m)
+}
+
+// print prints the result of a command. Results without a String method are
+// printed as JSON in both modes.
+func (c *CLI) print(res interface{}) {
+	if res == nil {
+		return
+	}
+	if s, ok := res.(fmt.Stringer); ok && !c.JSON {
+		fmt.Fprintln(c.out, s.String())
+		return
+	}
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(res); err != nil {
+		fmt.Fprintln(c.out, "Couldn't encode result: ", err)
+	}
+}
+
+// printError prints why a command failed, with the usage of the command for
+// errors in the command line.
+func (c *CLI) printError(args []string, err error) {
+	if c.JSON || hasJSONFlag(args) {
+		_, e := newGatewayError(err)
+		c.print(e)
+		return
+	}
+	fmt.Fprintln(c.out, "Error:", err)
+	var trap *TrapError
+	if errors.As(err, &trap) {
+		fmt.Fprint(c.out, string(trap.Log))
+		for _, f := range trap.Backtrace {
+			fmt.Fprintln(c.out, "    at", f)
+		}
+	}
+	var badReq errBadRequest
+	if errors.As(err, &badReq) && len(args) > 0 {
+		if cmd := lookupCommand(args[0]); cmd != nil {
+			fmt.Fprintln(c.out, "Usage:", cmd.usage())
+		}
+	}
+}
+
+func hasJSONFlag(args []string) bool {
+	for _, a := range args {
+		if a == "--" {
+			return false
+		}
+		if a == "--json" || a == "-json" || a == "--json=true" || a == "-json=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// helpText lists the commands, or describes one with its flags.
+type helpText string
+
+func (h helpText) String() string {
+	return strings.TrimRight(string(h), "\n")
+}
+
+func commandHelp(cmd *command) helpText {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Usage: %s\n\n%s\n", cmd.usage(), cmd.help)
+	if cmd.local {
+		b.WriteString("Not available through the daemon.\n")
+	}
+	if fs, _ := cmd.flagSet(); countFlags(fs) > 0 {
+		b.WriteString("\nFlags:\n")
+		fs.SetOutput(&b)
+		fs.PrintDefaults()
+	}
+	return helpText(b.String())
+}
+
+func listCommands() helpText {
+	names := make([]string, 0, len(commands))
+	width := 0
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+		if len(cmd.usage()) > width {
+			width = len(cmd.usage())
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Commands:\n")
+	for _, name := range names {
+		cmd := lookupCommand(name)
+		fmt.Fprintf(&b, "  %-*s  %s\n", width, cmd.usage(), strings.SplitN(cmd.help, "\n", 2)[0])
+	}
+	b.WriteString("\nAll commands take --json to print their result as JSON. Run help <command> for its flags.")
+	return helpText(b.String())
+}
+
+// localNode runs the commands available through the API on a local peer.
+type localNode struct {
+	p *Peer
+}
+
+func (n localNode) ID(ctx context.Context) (*PeerInfo, error) {
+	return n.p.info()
+}
+
+func (n localNode) Connect(ctx context.Context, addr string) error {
+	return n.p.connectAddr(addr)
+}
+
+func (n localNode) Add(ctx context.Context, r io.Reader) (cid.Cid, error) {
+	nd, err := n.p.AddFile(ctx, r, &AddParams{})
+	if err != nil {
+		return cid.Undef, err
+	}
+	return nd.Cid(), nil
+}
+
+func (n localNode) Get(ctx context.Context, f cid.Cid) (io.ReadCloser, error) {
+	return n.p.GetFile(ctx, f)
+}
+
+func (n localNode) ABI(ctx context.Context, fn cid.Cid) (*FxABI, error) {
+	return n.p.GetABI(ctx, fn)
+}
+
+func (n localNode) Deploy(ctx context.Context, abi FxABI, bytecode []byte) (cid.Cid, error) {
+	c, err := n.p.DeployABI(ctx, abi, bytecode)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return *c, nil
+}
+
+func (n localNode) Call(ctx context.Context, fn cid.Cid, fx string, args []cid.Cid) (*CallResult, error) {
+	r, err := n.p.CallReceipt(ctx, fn, fx, args)
+	if err != nil {
+		return nil, err
+	}
+	return newCallResult(r)
+}
+
+func (n localNode) Submit(ctx context.Context, fn cid.Cid, fx string, args []cid.Cid) (string, error) {
+	return n.p.Submit(ctx, fn, fx, args)
+}
+
+func (n localNode) Status(ctx context.Context, id string) (*Job, error) {
+	return n.p.Status(id)
+}
+
+func (n localNode) Wait(ctx context.Context, id string) (*Job, error) {
+	return n.p.Wait(ctx, id)
+}
+
+func (n localNode) Cancel(ctx context.Context, id string) (*Job, error) {
+	if err := n.p.Cancel(id); err != nil {
+		return nil, err
+	}
+	return n.p.Status(id)
+}
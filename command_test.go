@@ -0,0 +1,185 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitArgs(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"":                                 {},
+		"  # a comment":                    {},
+		"add hello":                        {"add", "hello"},
+		"  add   hello  ":                  {"add", "hello"},
+		`add "hello world"`:                {"add", "hello world"},
+		`add 'it''s'`:                      {"add", "its"},
+		`add "say \"hi\""`:                 {"add", `say "hi"`},
+		`add 'no \escapes'`:                {"add", `no \escapes`},
+		`add-file my\ file_v2.txt`:         {"add-file", "my file_v2.txt"},
+		`add ""`:                           {"add", ""},
+		"add a#b":                          {"add", "a#b"},
+		"call fn --fx map --arg a --arg b": {"call", "fn", "--fx", "map", "--arg", "a", "--arg", "b"},
+	} {
+		args, err := SplitArgs(line)
+		if err != nil {
+			t.Errorf("%s: %s", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("%s: expected %q, got %q", line, expected, args)
+		}
+	}
+
+	for _, bad := range []string{`add "hello`, `add 'hello`, `add hello\`} {
+		if _, err := SplitArgs(bad); err == nil {
+			t.Errorf("%s should not split", bad)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	fs := flag.NewFlagSet("call", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fx := fs.String("fx", "", "")
+	args := &stringList{}
+	fs.Var(args, "arg", "")
+
+	pos, err := parseArgs(fs, []string{"a", "--fx", "map", "b", "--arg", "x", "--", "--arg", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pos, []string{"a", "b", "--arg", "c"}) {
+		t.Errorf("unexpected positional arguments %q", pos)
+	}
+	if *fx != "map" || !reflect.DeepEqual([]string(*args), []string{"x"}) {
+		t.Errorf("unexpected flags %q %q", *fx, *args)
+	}
+
+	if _, err := parseArgs(fs, []string{"--unknown"}); err == nil {
+		t.Error("unknown flags should fail")
+	}
+}
+
+func TestCLI(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+	var out bytes.Buffer
+	c := NewCLI(p, &out)
+
+	run := func(line string) (string, error) {
+		out.Reset()
+		err := c.RunLine(ctx, line)
+		return out.String(), err
+	}
+
+	// Strings with underscores and spaces are kept as they are.
+	res, err := run(`add "hello_world and more"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(res, "Added string with CID: ") {
+		t.Fatalf("unexpected output %q", res)
+	}
+	added := strings.TrimSpace(strings.TrimPrefix(res, "Added string with CID: "))
+
+	if res, err = run("get " + added); err != nil || res != "hello_world and more\n" {
+		t.Errorf("unexpected get output %q, %v", res, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "out_file.txt")
+	if _, err = run("get /ipfs/" + added + " --out " + file); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != "hello_world and more" {
+		t.Errorf("unexpected file content %q", b)
+	}
+
+	res, err = run("add --json hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := cidResult{}
+	if err := json.Unmarshal([]byte(res), &cr); err != nil || !cr.Cid.Defined() {
+		t.Errorf("unexpected JSON output %q, %v", res, err)
+	}
+	if c.JSON {
+		t.Error("--json should only apply to its command")
+	}
+
+	// Errors in the command line are reported with the usage.
+	res, err = run("call " + added)
+	if err == nil || !strings.Contains(res, "--fx is required") || !strings.Contains(res, "Usage: call <fnCid> [flags]") {
+		t.Errorf("unexpected output %q, %v", res, err)
+	}
+	res, err = run("mapreduce " + added + " " + added + " --reduce reduce")
+	if err == nil || !strings.Contains(res, "--map is required") {
+		t.Errorf("unexpected output %q, %v", res, err)
+	}
+	res, err = run("add a b")
+	if err == nil || !strings.Contains(res, "wrong number of arguments") {
+		t.Errorf("unexpected output %q, %v", res, err)
+	}
+
+	c.JSON = true
+	res, err = run("unknown")
+	if err == nil {
+		t.Fatal("unknown commands should fail")
+	}
+	ge := GatewayError{}
+	if err := json.Unmarshal([]byte(res), &ge); err != nil || ge.Kind != "request" {
+		t.Errorf("unexpected JSON error %q, %v", res, err)
+	}
+
+	// Commands needing a local peer aren't available through a daemon.
+	c = NewClientCLI(NewClient("unix:"+filepath.Join(t.TempDir(), "api.sock")), &out)
+	if res, err = run("work pool"); err == nil || !strings.Contains(res, "isn't available through the daemon") {
+		t.Errorf("unexpected output %q, %v", res, err)
+	}
+}
+
+func TestScript(t *testing.T) {
+	ctx := context.Background()
+	var out bytes.Buffer
+	c := NewCLI(dagPeer(t), &out)
+
+	script := filepath.Join(t.TempDir(), "script.ipl")
+	lines := "# adds two strings\n\nadd 'first line'\nadd second\nget notacid\nadd never\n"
+	if err := ioutil.WriteFile(script, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := c.RunScript(ctx, script)
+	if err == nil || !strings.Contains(err.Error(), "script.ipl:5:") {
+		t.Errorf("expected the script to stop at line 5, got %v", err)
+	}
+	if n := strings.Count(out.String(), "Added string"); n != 2 {
+		t.Errorf("expected 2 strings added, got %d in %q", n, out.String())
+	}
+
+	// Variables hold the CIDs printed by commands.
+	out.Reset()
+	lines = "s = add hello\nget $s\nid = id\n"
+	if err := ioutil.WriteFile(script, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = c.RunScript(ctx, script)
+	if err == nil || !strings.Contains(err.Error(), "script.ipl:3:") {
+		t.Errorf("expected the script to stop at line 3, got %v", err)
+	}
+	if !strings.Contains(out.String(), "\nhello\n") {
+		t.Errorf("expected the string got back, got %q", out.String())
+	}
+	lines = "get $nope\n"
+	if err := ioutil.WriteFile(script, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RunScript(ctx, script); err == nil || !strings.Contains(err.Error(), "undefined variable $nope") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
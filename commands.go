@@ -0,0 +1,661 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// commands are the subcommands of the CLI. They are set in init as some of
+// them run other commands.
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "help", args: "[command]", nargs: -1,
+			help:  "Lists the commands, or describes a command and its flags.",
+			flags: noFlags(runHelp)},
+		{name: "script", args: "<file>", nargs: 1,
+			help: "Runs a file of commands, one per line, stopping at the first one failing.\nLines starting with # are comments. A line like \"fn = deploy ...\" stores the CID\nprinted by the command in fn, given to later commands as $fn.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				return nil, c.runScript(ctx, args[0])
+			})},
+		{name: "id", nargs: 0,
+			help: "Prints the ID and addresses of the peer.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				info, err := c.node.ID(ctx)
+				if err != nil {
+					return nil, err
+				}
+				return idResult{info}, nil
+			})},
+		{name: "connect", args: "<multiaddr>", nargs: 1,
+			help: "Connects to a peer, given as /ip4/<ip>/tcp/<port>/p2p/<peerId>.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				if err := c.node.Connect(ctx, args[0]); err != nil {
+					return nil, err
+				}
+				return message("Connected to: " + args[0]), nil
+			})},
+		{name: "add", args: "<string>", nargs: 1,
+			help: "Adds a string.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				added, err := c.node.Add(ctx, strings.NewReader(args[0]))
+				if err != nil {
+					return nil, err
+				}
+				return cidResult{"Added string with CID", added}, nil
+			})},
+		{name: "add-file", args: "<file>", nargs: 1,
+			help: "Adds a file.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				data, err := ioutil.ReadFile(args[0])
+				if err != nil {
+					return nil, err
+				}
+				added, err := c.node.Add(ctx, bytes.NewReader(data))
+				if err != nil {
+					return nil, err
+				}
+				return cidResult{"Added file with CID", added}, nil
+			})},
+		{name: "get", args: "<cid|path>", nargs: 1,
+			help:  "Prints a file, given by its CID or a path like /ipfs/<cid> or /compute/<fnCid>/<fx>/<argCid>,<argCid>.\nCompute paths are only available on a local peer.",
+			flags: getCmd},
+		{name: "abi", args: "<fnCid>", nargs: 1,
+			help: "Prints the ABI of a function.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				fn, err := parseCid(args[0])
+				if err != nil {
+					return nil, err
+				}
+				return c.node.ABI(ctx, fn)
+			})},
+		{name: "deploy", args: "<bytecode>", nargs: 1,
+			help:  "Deploys the functions of a WASM module.",
+			flags: deployCmd},
+		{name: "deploy-lib", args: "<bytecode>", nargs: 1, local: true,
+			help: "Deploys a library to link in the Deps of other functions.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				bytecode, err := ioutil.ReadFile(args[0])
+				if err != nil {
+					return nil, err
+				}
+				lib, err := c.peer.DeployLibrary(ctx, bytecode)
+				if err != nil {
+					return nil, err
+				}
+				return cidResult{"Deployed library at", *lib}, nil
+			})},
+		{name: "verify", args: "<fnCid>", nargs: 1, local: true,
+			help: "Runs the test vectors of the ABI of a function and prints the report.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				fn, err := parseCid(args[0])
+				if err != nil {
+					return nil, err
+				}
+				return c.peer.Verify(ctx, fn)
+			})},
+		{name: "source", args: "<fnCid>", nargs: 1,
+			help: "Prints the source linked to a function.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				fn, err := parseCid(args[0])
+				if err != nil {
+					return nil, err
+				}
+				abi, err := c.node.ABI(ctx, fn)
+				if err != nil {
+					return nil, err
+				}
+				if abi.Source == nil {
+					return nil, fmt.Errorf("no source linked to %s", fn)
+				}
+				return abi.Source, nil
+			})},
+		{name: "fetch-source", args: "<fnCid> <dir>", nargs: 2, local: true,
+			help: "Writes the source linked to a function to a directory.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				fn, err := parseCid(args[0])
+				if err != nil {
+					return nil, err
+				}
+				abi, err := c.peer.GetABI(ctx, fn)
+				if err != nil {
+					return nil, err
+				}
+				if abi.Source == nil {
+					return nil, fmt.Errorf("no source linked to %s", fn)
+				}
+				if err := c.peer.GetSourceTree(ctx, abi.Source.Tree, args[1]); err != nil {
+					return nil, err
+				}
+				return message("Source written to: " + args[1]), nil
+			})},
+		{name: "set-source", args: "<fnCid> <dir>", nargs: 2, local: true,
+			help:  "Adds a source directory and deploys the function again with it linked.",
+			flags: setSourceCmd},
+		{name: "set-debug-info", args: "<fnCid> <debugBytecode>", nargs: 2, local: true,
+			help: "Deploys the function again with the DWARF sections of a debug build, to symbolize traps.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				fn, err := parseCid(args[0])
+				if err != nil {
+					return nil, err
+				}
+				debug, err := ioutil.ReadFile(args[1])
+				if err != nil {
+					return nil, err
+				}
+				deployed, err := c.peer.SetDebugInfo(ctx, fn, debug)
+				if err != nil {
+					return nil, err
+				}
+				return cidResult{"Deployed function at", *deployed}, nil
+			})},
+		{name: "call", args: "<fnCid>", nargs: 1,
+			help:  "Calls a function.",
+			flags: callCmd},
+		{name: "submit", args: "<fnCid>", nargs: 1,
+			help: "Submits a call as a background job and prints the ID of the job.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				fx, fargs := callFlags(fs)
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					fn, err := parseCall(args[0], *fx)
+					if err != nil {
+						return nil, err
+					}
+					id, err := c.node.Submit(ctx, fn, *fx, *fargs)
+					if err != nil {
+						return nil, err
+					}
+					return jobIDResult{id}, nil
+				}
+			}},
+		{name: "status", args: "<jobId>", nargs: 1,
+			help: "Prints the state of a job.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				return c.node.Status(ctx, args[0])
+			})},
+		{name: "wait", args: "<jobId>", nargs: 1,
+			help: "Waits for a job to finish and prints it.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				return c.node.Wait(ctx, args[0])
+			})},
+		{name: "cancel", args: "<jobId>", nargs: 1,
+			help: "Cancels a job.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				return c.node.Cancel(ctx, args[0])
+			})},
+		{name: "work", args: "<pool>", nargs: 1, local: true,
+			help: "Runs the jobs of a pool of workers.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				return c.serve(ctx, "Working for pool: "+args[0], func(ctx context.Context) error {
+					return c.peer.Work(ctx, args[0])
+				})
+			})},
+		{name: "call-pool", args: "<pool> <fnCid>", nargs: 2, local: true,
+			help: "Calls a function on a worker of a pool.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				fx, fargs := callFlags(fs)
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					fn, err := parseCall(args[1], *fx)
+					if err != nil {
+						return nil, err
+					}
+					job, err := c.peer.CallPool(ctx, args[0], fn, *fx, *fargs)
+					if err != nil {
+						return nil, err
+					}
+					return poolJobResult{job}, nil
+				}
+			}},
+		{name: "gateway", args: "<addr>", nargs: 1, local: true,
+			help: "Serves the HTTP gateway, e.g. at localhost:8080.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				return c.serve(ctx, "Serving gateway at: "+args[0], func(ctx context.Context) error {
+					return c.peer.ServeGateway(ctx, args[0])
+				})
+			})},
+		{name: "plan", args: "<fnCid>", nargs: 1, local: true,
+			help: "Prints what a call would fetch and run, without running it.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				fx, fargs := callFlags(fs)
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					fn, err := parseCall(args[0], *fx)
+					if err != nil {
+						return nil, err
+					}
+					return c.peer.Plan(ctx, fn, *fx, *fargs)
+				}
+			}},
+		{name: "thunk", args: "<fnCid>", nargs: 1, local: true,
+			help: "Adds a call as a thunk, to pass it as an argument evaluated lazily.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				fx, fargs := callFlags(fs)
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					fn, err := parseCall(args[0], *fx)
+					if err != nil {
+						return nil, err
+					}
+					t, err := c.peer.NewThunk(ctx, fn, *fx, *fargs)
+					if err != nil {
+						return nil, err
+					}
+					return cidResult{"Thunk CID", *t}, nil
+				}
+			}},
+		{name: "mapreduce", args: "<fnCid> <inputCid>", nargs: 2, local: true,
+			help: "Maps the chunks of a file and reduces their outputs.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				mapFx := fs.String("map", "", "name of the map function")
+				reduceFx := fs.String("reduce", "", "name of the reduce function")
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					if err := required("map", *mapFx); err != nil {
+						return nil, err
+					}
+					if err := required("reduce", *reduceFx); err != nil {
+						return nil, err
+					}
+					fn, err := parseCall(args[0], *mapFx)
+					if err != nil {
+						return nil, err
+					}
+					input, err := parseCid(args[1])
+					if err != nil {
+						return nil, err
+					}
+					out, err := c.peer.MapReduce(ctx, fn, *mapFx, *reduceFx, input)
+					if err != nil {
+						return nil, err
+					}
+					return cidResult{"Output CID", *out}, nil
+				}
+			}},
+		{name: "fold", args: "<fnCid> <inputCid>", nargs: 2, local: true,
+			help: "Folds a function over the chunks of a file.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				fx, fargs := callFlags(fs)
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					fn, err := parseCall(args[0], *fx)
+					if err != nil {
+						return nil, err
+					}
+					input, err := parseCid(args[1])
+					if err != nil {
+						return nil, err
+					}
+					out, err := c.peer.Fold(ctx, fn, *fx, input, *fargs)
+					if err != nil {
+						return nil, err
+					}
+					return cidResult{"Output CID", *out}, nil
+				}
+			}},
+		{name: "call-resumable", args: "<fnCid>", nargs: 1, local: true,
+			help: "Calls a function, taking a checkpoint if it runs out of steps.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				fx, fargs := callFlags(fs)
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					fn, err := parseCall(args[0], *fx)
+					if err != nil {
+						return nil, err
+					}
+					res, err := c.peer.CallResumable(ctx, fn, *fx, *fargs)
+					if err != nil {
+						return nil, err
+					}
+					return resumableResult{res}, nil
+				}
+			}},
+		{name: "resume", args: "<checkpointCid>", nargs: 1, local: true,
+			help: "Resumes a call from a checkpoint.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				checkpoint, err := parseCid(args[0])
+				if err != nil {
+					return nil, err
+				}
+				res, err := c.peer.Resume(ctx, checkpoint)
+				if err != nil {
+					return nil, err
+				}
+				return resumableResult{res}, nil
+			})},
+		{name: "spawn", args: "<actorId> <fnCid>", nargs: 2, local: true,
+			help: "Spawns an actor handling its messages with a function.",
+			flags: func(fs *flag.FlagSet) runFunc {
+				fx := fs.String("fx", "", "name of the function handling messages")
+				state := fs.String("state", "", "CID of the initial state")
+				return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+					fn, err := parseCall(args[1], *fx)
+					if err != nil {
+						return nil, err
+					}
+					if err := required("state", *state); err != nil {
+						return nil, err
+					}
+					st, err := parseCid(*state)
+					if err != nil {
+						return nil, err
+					}
+					head, err := c.peer.SpawnActor(ctx, args[0], fn, *fx, st)
+					if err != nil {
+						return nil, err
+					}
+					return cidResult{"Actor spawned with head", *head}, nil
+				}
+			}},
+		{name: "send", args: "<actorId> <msgCid>", nargs: 2, local: true,
+			help: "Sends a message to an actor.",
+			flags: noFlags(func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+				msg, err := parseCid(args[1])
+				if err != nil {
+					return nil, err
+				}
+				entry, err := c.peer.Send(ctx, args[0], msg)
+				if err != nil {
+					return nil, err
+				}
+				return sendResult{entry}, nil
+			})},
+	}
+}
+
+func runHelp(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+	switch len(args) {
+	case 0:
+		return listCommands(), nil
+	case 1:
+		cmd := lookupCommand(args[0])
+		if cmd == nil {
+			return nil, badRequest(fmt.Errorf("unknown command %q", args[0]))
+		}
+		return commandHelp(cmd), nil
+	}
+	return nil, badRequest(errors.New("wrong number of arguments"))
+}
+
+// callFlags defines the flags of the commands calling a function.
+func callFlags(fs *flag.FlagSet) (*string, *cidList) {
+	fx := fs.String("fx", "", "name of the function to call")
+	args := &cidList{}
+	fs.Var(args, "arg", "CID of an argument, repeated for each argument")
+	return fx, args
+}
+
+// parseCall parses the function of a call, checking its name was given.
+func parseCall(fnCid, fx string) (cid.Cid, error) {
+	if err := required("fx", fx); err != nil {
+		return cid.Undef, err
+	}
+	return parseCid(fnCid)
+}
+
+// fetch returns the content of a file.
+func (c *CLI) fetch(ctx context.Context, f cid.Cid) ([]byte, error) {
+	rc, err := c.node.Get(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(rc)
+}
+
+// serve runs a command serving the peer until ctx is done, or in the
+// background.
+func (c *CLI) serve(ctx context.Context, msg string, f func(ctx context.Context) error) (interface{}, error) {
+	if c.Background {
+		go func() {
+			if err := f(c.peer.ctx); err != nil && err != context.Canceled {
+				fmt.Fprintln(c.out, "Stopped: ", err)
+			}
+		}()
+		return message(msg), nil
+	}
+	c.print(message(msg))
+	if err := f(ctx); err != nil && err != context.Canceled {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func getCmd(fs *flag.FlagSet) runFunc {
+	out := fs.String("out", "", "write the file to this path instead of printing it")
+	return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+		var data []byte
+		if c.peer != nil {
+			rsc, err := c.peer.GetPath(ctx, args[0])
+			if err != nil {
+				return nil, err
+			}
+			defer rsc.Close()
+			if data, err = ioutil.ReadAll(rsc); err != nil {
+				return nil, err
+			}
+		} else {
+			f, err := parseCid(strings.TrimPrefix(args[0], "/ipfs/"))
+			if err != nil {
+				return nil, err
+			}
+			if data, err = c.fetch(ctx, f); err != nil {
+				return nil, err
+			}
+		}
+
+		res := fileResult{Path: args[0], Size: len(data)}
+		if *out == "" {
+			res.Data = data
+			return res, nil
+		}
+		res.Out = *out
+		return res, ioutil.WriteFile(*out, data, 0644)
+	}
+}
+
+func deployCmd(fs *flag.FlagSet) runFunc {
+	fxs := &stringList{}
+	fs.Var(fxs, "fx", "name of an exported function, repeated for each function")
+	types := &stringList{}
+	fs.Var(types, "type", "type of an argument as <name>[@<schemaCid>], repeated for each argument")
+	conv := fs.String("conv", "rust", "calling convention: rust, rust-dealloc, tinygo, assemblyscript or c")
+	libs := &stringList{}
+	fs.Var(libs, "lib", "library to link as <name>=<libCid>, repeated for each library")
+	return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+		if len(*fxs) == 0 {
+			return nil, required("fx", "")
+		}
+		abi := FxABI{Fxs: *fxs}
+		for _, k := range *types {
+			t, err := parseType(k)
+			if err != nil {
+				return nil, badRequest(err)
+			}
+			abi.Args = append(abi.Args, t)
+		}
+		var err error
+		if abi.Convention, err = CallConvByName(*conv); err != nil {
+			return nil, badRequest(err)
+		}
+		for _, l := range *libs {
+			deps, err := parseDeps(l)
+			if err != nil {
+				return nil, badRequest(err)
+			}
+			abi.Deps = append(abi.Deps, deps...)
+		}
+
+		bytecode, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		fn, err := c.node.Deploy(ctx, abi, bytecode)
+		if err != nil {
+			return nil, err
+		}
+		return cidResult{"Deployed function at", fn}, nil
+	}
+}
+
+func setSourceCmd(fs *flag.FlagSet) runFunc {
+	toolchain := fs.String("toolchain", "", "toolchain building the source, e.g. \"rustc 1.48.0\"")
+	build := fs.String("build", "", "command building the bytecode from the source")
+	return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+		if err := required("toolchain", *toolchain); err != nil {
+			return nil, err
+		}
+		if err := required("build", *build); err != nil {
+			return nil, err
+		}
+		fn, err := parseCid(args[0])
+		if err != nil {
+			return nil, err
+		}
+		tree, err := c.peer.AddSourceTree(ctx, args[1])
+		if err != nil {
+			return nil, err
+		}
+		deployed, err := c.peer.SetSource(ctx, fn, Source{Tree: tree.Cid(), Toolchain: *toolchain, Build: *build})
+		if err != nil {
+			return nil, err
+		}
+		return sourceResult{Tree: tree.Cid(), Fn: *deployed}, nil
+	}
+}
+
+func callCmd(fs *flag.FlagSet) runFunc {
+	fx, fargs := callFlags(fs)
+	profile := fs.Bool("profile", false, "print where the time of the call went, only on a local peer")
+	out := fs.String("out", "", "write the output to this path")
+	return func(ctx context.Context, c *CLI, args []string) (interface{}, error) {
+		fn, err := parseCall(args[0], *fx)
+		if err != nil {
+			return nil, err
+		}
+		res := callOutput{}
+		if *profile {
+			if c.peer == nil {
+				return nil, errors.New("--profile isn't available through the daemon")
+			}
+			r, pr, err := c.peer.CallProfile(ctx, fn, *fx, *fargs)
+			if err != nil {
+				return nil, err
+			}
+			if res.CallResult, err = newCallResult(r); err != nil {
+				return nil, err
+			}
+			res.Profile = pr
+		} else if res.CallResult, err = c.node.Call(ctx, fn, *fx, *fargs); err != nil {
+			return nil, err
+		}
+
+		if res.Log != nil {
+			logs, err := c.fetch(ctx, *res.Log)
+			if err != nil {
+				return nil, err
+			}
+			res.Logs = string(logs)
+		}
+		if *out != "" {
+			data, err := c.fetch(ctx, res.Output)
+			if err != nil {
+				return nil, err
+			}
+			if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+				return nil, err
+			}
+			res.Out = *out
+		}
+		return res, nil
+	}
+}
+
+type idResult struct {
+	*PeerInfo
+}
+
+func (r idResult) String() string {
+	return fmt.Sprintf("Peer ID: %s\nListening at: %s", r.ID.Pretty(), strings.Join(r.Addrs, " "))
+}
+
+type fileResult struct {
+	Path string
+	Out  string `json:",omitempty"`
+	Size int
+	Data []byte `json:",omitempty"`
+}
+
+func (r fileResult) String() string {
+	if r.Out != "" {
+		return fmt.Sprintf("Written %d bytes to: %s", r.Size, r.Out)
+	}
+	return string(r.Data)
+}
+
+type sourceResult struct {
+	Tree cid.Cid
+	Fn   cid.Cid
+}
+
+func (r sourceResult) String() string {
+	return fmt.Sprintf("Source tree added at: %s\nDeployed function at: %s", r.Tree, r.Fn)
+}
+
+type callOutput struct {
+	*CallResult
+	Logs    string   `json:",omitempty"`
+	Out     string   `json:",omitempty"`
+	Profile *Profile `json:",omitempty"`
+}
+
+func (r callOutput) String() string {
+	s := r.Logs + "Output CID: " + r.Output.String()
+	if r.Out != "" {
+		s += "\nOutput written to: " + r.Out
+	}
+	if r.Profile != nil {
+		s += "\n" + r.Profile.String()
+	}
+	return s
+}
+
+type jobIDResult struct {
+	ID string
+}
+
+func (r jobIDResult) String() string {
+	return "Submitted job: " + r.ID
+}
+
+type poolJobResult struct {
+	*Job
+}
+
+func (r poolJobResult) String() string {
+	return fmt.Sprintf("%s on %s", r.Job, r.Worker.Pretty())
+}
+
+type resumableResult struct {
+	*ResumableResult
+}
+
+func (r resumableResult) String() string {
+	if r.Output != nil {
+		return "Output CID: " + r.Output.String()
+	}
+	return "Checkpoint CID: " + r.Checkpoint.String()
+}
+
+type sendResult struct {
+	*ActorEntry
+}
+
+func (r sendResult) String() string {
+	if r.Reply == nil {
+		return "New state CID: " + r.State.String()
+	}
+	return fmt.Sprintf("New state CID: %s\nReply CID: %s", r.State, r.Reply)
+}
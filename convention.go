@@ -0,0 +1,375 @@
+package ipfslite
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// ArgsMode determines how arguments are laid out in guest memory.
+type ArgsMode string
+
+// ResultMode determines how a guest function hands its result back to the host.
+type ResultMode string
+
+const (
+	// ArgsLinear concatenates every argument into a single buffer. The function
+	// receives the pointer to the buffer followed by the length of each argument.
+	ArgsLinear ArgsMode = "linear"
+	// ArgsSeparate allocates a buffer for each argument. The function receives a
+	// (ptr, len) pair per argument.
+	ArgsSeparate ArgsMode = "separate"
+
+	// ResultInPlace means the function writes its result over the input buffer
+	// and returns its length as an i32.
+	ResultInPlace ResultMode = "inplace"
+	// ResultPair means the function returns the result as a (ptr, len) pair of
+	// i32 using multi-value returns. The region must be freshly allocated by
+	// the guest, and it is released with dealloc once copied.
+	ResultPair ResultMode = "pair"
+	// ResultPacked means the function returns a single i64 with the pointer to
+	// the result in the high 32 bits and its length in the low 32 bits. As with
+	// ResultPair, the region is released with dealloc once copied.
+	ResultPacked ResultMode = "packed"
+)
+
+// CallConv is the calling convention used by the host to talk to a guest
+// module. Every toolchain exports its own memory management functions and
+// passes values around in its own way, so each ABI declares the one it was
+// compiled with.
+type CallConv struct {
+	Alloc   string     // Name of the export used to allocate guest memory.
+	Dealloc string     `json:",omitempty"` // Name of the export used to free guest memory, if any.
+	Args    ArgsMode   // How arguments are laid out in memory.
+	Result  ResultMode // How results are returned.
+}
+
+var (
+	// RustConv is the convention followed by the Rust examples in functions/.
+	// It is used by default when an ABI doesn't declare one.
+	RustConv = CallConv{Alloc: "alloc", Args: ArgsLinear, Result: ResultInPlace}
+	// RustDeallocConv is the convention for Rust modules that export a
+	// dealloc(ptr, size) and return a freshly allocated result.
+	RustDeallocConv = CallConv{Alloc: "alloc", Dealloc: "dealloc", Args: ArgsSeparate, Result: ResultPacked}
+	// TinyGoConv is the convention for TinyGo modules exporting malloc/free.
+	TinyGoConv = CallConv{Alloc: "malloc", Dealloc: "free", Args: ArgsSeparate, Result: ResultPacked}
+	// AssemblyScriptConv is the convention for AssemblyScript modules built with
+	// the exported runtime. Memory is garbage collected so there is no dealloc.
+	AssemblyScriptConv = CallConv{Alloc: "__new", Args: ArgsSeparate, Result: ResultPacked}
+	// CConv is the convention for C modules built against a libc exporting
+	// malloc/free.
+	CConv = CallConv{Alloc: "malloc", Dealloc: "free", Args: ArgsSeparate, Result: ResultPacked}
+)
+
+// CallConvByName returns one of the predefined conventions from its name
+// (rust, rust-dealloc, tinygo, assemblyscript or c).
+func CallConvByName(name string) (CallConv, error) {
+	switch strings.ToLower(name) {
+	case "rust", "":
+		return RustConv, nil
+	case "rust-dealloc":
+		return RustDeallocConv, nil
+	case "tinygo":
+		return TinyGoConv, nil
+	case "assemblyscript", "as":
+		return AssemblyScriptConv, nil
+	case "c":
+		return CConv, nil
+	default:
+		return CallConv{}, fmt.Errorf("unknown calling convention: %s", name)
+	}
+}
+
+// withDefaults fills the fields left empty in the ABI with the ones
+// from RustConv so old manifests keep working.
+func (cc CallConv) withDefaults() CallConv {
+	if cc.Alloc == "" {
+		cc.Alloc = RustConv.Alloc
+	}
+	if cc.Args == "" {
+		cc.Args = RustConv.Args
+	}
+	if cc.Result == "" {
+		cc.Result = RustConv.Result
+	}
+	return cc
+}
+
+// region of guest memory allocated through the alloc export.
+type region struct {
+	ptr  int32
+	size int32
+	// pinned regions are unpinned when released.
+	pinned bool
+}
+
+// guest wraps an instance with the exports needed to exchange data with it.
+type guest struct {
+	cc      CallConv
+	memory  *wasmtime.Memory
+	alloc   *wasmtime.Func
+	dealloc *wasmtime.Func
+	// pin and unpin keep the regions allocated by the host from being
+	// collected by garbage collected runtimes, like AssemblyScript's.
+	pin   *wasmtime.Func
+	unpin *wasmtime.Func
+
+	// Regions to be released once the output has been copied out.
+	allocated []region
+	// maxPages limits the memory of the guest, see Policy.MaxMemoryPages.
+	maxPages uint32
+
+	// What the function logs while it runs.
+	logs *callLog
+}
+
+func newGuest(instance *wasmtime.Instance, cc CallConv) (*guest, error) {
+	g := &guest{cc: cc.withDefaults()}
+
+	mem := instance.GetExport("memory")
+	if mem == nil || mem.Memory() == nil {
+		return nil, &ExportError{Name: "memory", Kind: "memory"}
+	}
+	g.memory = mem.Memory()
+
+	alloc := instance.GetExport(g.cc.Alloc)
+	if alloc == nil || alloc.Func() == nil {
+		return nil, &ExportError{Name: g.cc.Alloc, Kind: "function"}
+	}
+	g.alloc = alloc.Func()
+
+	if g.cc.Dealloc != "" {
+		dealloc := instance.GetExport(g.cc.Dealloc)
+		if dealloc == nil || dealloc.Func() == nil {
+			return nil, &ExportError{Name: g.cc.Dealloc, Kind: "function"}
+		}
+		g.dealloc = dealloc.Func()
+	}
+
+	pin, unpin := instance.GetExport("__pin"), instance.GetExport("__unpin")
+	if pin != nil && pin.Func() != nil && unpin != nil && unpin.Func() != nil {
+		g.pin, g.unpin = pin.Func(), unpin.Func()
+	}
+	return g, nil
+}
+
+// malloc reserves size bytes of guest memory.
+func (g *guest) malloc(size int) (int32, error) {
+	args := []interface{}{int32(size)}
+	// AssemblyScript's __new also expects the class id of the object. An
+	// ArrayBuffer has id 1.
+	if g.alloc.ParamArity() == 2 {
+		args = append(args, int32(1))
+	}
+	ret, err := g.alloc.Call(args...)
+	if err != nil {
+		return 0, err
+	}
+	ptr, ok := ret.(int32)
+	if !ok {
+		return 0, fmt.Errorf("alloc function %s returned %T instead of i32", g.cc.Alloc, ret)
+	}
+	r := region{ptr: ptr, size: int32(size)}
+	if g.pin != nil {
+		// The collector may run while the function is called, before it
+		// reads its arguments.
+		if _, err := g.pin.Call(ptr); err != nil {
+			return 0, err
+		}
+		r.pinned = true
+	}
+	g.allocated = append(g.allocated, r)
+	return ptr, nil
+}
+
+// free releases every region allocated by the host and the ones
+// returned by the guest, returning the first error.
+func (g *guest) free() error {
+	regions := g.allocated
+	g.allocated = nil
+	var err error
+	for _, r := range regions {
+		if rerr := g.release(r); err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// release unpins and frees a single region. Regions are only freed if the
+// convention has a dealloc.
+func (g *guest) release(r region) error {
+	for i, a := range g.allocated {
+		if a == r {
+			g.allocated = append(g.allocated[:i], g.allocated[i+1:]...)
+			break
+		}
+	}
+	if r.pinned {
+		if _, err := g.unpin.Call(r.ptr); err != nil {
+			return err
+		}
+	}
+	if g.dealloc == nil {
+		return nil
+	}
+	args := []interface{}{r.ptr}
+	// Rust-like deallocs need the size of the region, free() only takes
+	// the pointer.
+	if g.dealloc.ParamArity() == 2 {
+		args = append(args, r.size)
+	}
+	_, err := g.dealloc.Call(args...)
+	return err
+}
+
+// write copies data to guest memory starting at ptr.
+func (g *guest) write(ptr int32, data []byte) error {
+	// Take the slice here as memory may have grown after allocating.
+	buf := g.memory.UnsafeData()
+	if int(ptr) < 0 || int(ptr)+len(data) > len(buf) {
+		return &BoundsError{Ptr: ptr, Size: int32(len(data)), Limit: len(buf)}
+	}
+	copy(buf[ptr:], data)
+	return nil
+}
+
+// read copies size bytes of guest memory starting at ptr.
+func (g *guest) read(ptr int32, size int32) ([]byte, error) {
+	buf := g.memory.UnsafeData()
+	if ptr < 0 || size < 0 || int(ptr)+int(size) > len(buf) {
+		return nil, &BoundsError{Ptr: ptr, Size: size, Limit: len(buf)}
+	}
+	out := make([]byte, size)
+	copy(out, buf[ptr:ptr+size])
+	return out, nil
+}
+
+// invoke runs fx over the inputs following the calling convention and returns
+// a copy of its output. The regions allocated for the call are released
+// whether it succeeds or not.
+func (g *guest) invoke(fx *wasmtime.Func, inputs [][]byte) (out []byte, err error) {
+	defer func() {
+		if ferr := g.free(); err == nil && ferr != nil {
+			out, err = nil, ferr
+		}
+	}()
+
+	args, err := g.pushArgs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := g.call(fx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return g.output(ret)
+}
+
+// call calls a function of the guest, and checks that its memory didn't grow
+// past the limit once it returns.
+func (g *guest) call(fx *wasmtime.Func, args ...interface{}) (interface{}, error) {
+	ret, err := fx.Call(args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := memoryLimit(g.memory, g.maxPages); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// pushArgs copies the inputs to guest memory and returns the arguments to
+// call the function with.
+func (g *guest) pushArgs(inputs [][]byte) ([]interface{}, error) {
+	var args []interface{}
+
+	switch g.cc.Args {
+	case ArgsLinear:
+		linearInput := []byte{}
+		sizes := make([]interface{}, 0, len(inputs))
+		// Concatenate inputs linearly
+		for _, k := range inputs {
+			linearInput = append(linearInput, k...)
+			// Offsets to get parameters inside WASM.
+			sizes = append(sizes, int32(len(k)))
+		}
+		// Allocating extra 100 just in case the result is written in place.
+		ptr, err := g.malloc(len(linearInput) + 100)
+		if err != nil {
+			return nil, err
+		}
+		if err := g.write(ptr, linearInput); err != nil {
+			return nil, err
+		}
+		// Prepare arguments putting allocated pointer first
+		args = append([]interface{}{ptr}, sizes...)
+
+	case ArgsSeparate:
+		for _, k := range inputs {
+			ptr, err := g.malloc(len(k))
+			if err != nil {
+				return nil, err
+			}
+			if err := g.write(ptr, k); err != nil {
+				return nil, err
+			}
+			args = append(args, ptr, int32(len(k)))
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown args mode: %s", g.cc.Args)
+	}
+	return args, nil
+}
+
+// output copies the result of a function out of guest memory from the
+// values it returned.
+func (g *guest) output(ret interface{}) ([]byte, error) {
+	// Results are copied from memory after the call as it may have grown
+	// during the execution.
+	switch g.cc.Result {
+	case ResultInPlace:
+		size, ok := ret.(int32)
+		if !ok {
+			return nil, fmt.Errorf("function returned %T instead of i32", ret)
+		}
+		// The result is written over the first region allocated for the inputs.
+		if len(g.allocated) == 0 {
+			return nil, fmt.Errorf("no input buffer to read the output from")
+		}
+		if size < 0 || size > g.allocated[0].size {
+			return nil, &BoundsError{Ptr: g.allocated[0].ptr, Size: size, Limit: int(g.allocated[0].size)}
+		}
+		return g.read(g.allocated[0].ptr, size)
+
+	case ResultPair:
+		vals, ok := ret.([]wasmtime.Val)
+		if !ok || len(vals) != 2 {
+			return nil, fmt.Errorf("function didn't return a (ptr, len) pair")
+		}
+		return g.readResult(vals[0].I32(), vals[1].I32())
+
+	case ResultPacked:
+		packed, ok := ret.(int64)
+		if !ok {
+			return nil, fmt.Errorf("function returned %T instead of i64", ret)
+		}
+		return g.readResult(int32(uint64(packed)>>32), int32(uint32(packed)))
+
+	default:
+		return nil, fmt.Errorf("unknown result mode: %s", g.cc.Result)
+	}
+}
+
+// readResult copies a result region freshly allocated by the guest and
+// schedules it to be released with the inputs.
+func (g *guest) readResult(ptr int32, size int32) ([]byte, error) {
+	out, err := g.read(ptr, size)
+	if err != nil {
+		return nil, err
+	}
+	g.allocated = append(g.allocated, region{ptr: ptr, size: size})
+	return out, nil
+}
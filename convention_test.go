@@ -0,0 +1,251 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// runtimePeer returns a dagPeer that can also run functions.
+func runtimePeer(t *testing.T) *Peer {
+	p := dagPeer(t)
+	p.setupRuntime()
+	return p
+}
+
+// deployWat deploys the module written in src with the given ABI.
+func deployWat(t *testing.T, p *Peer, src string, abi FxABI) cid.Cid {
+	t.Helper()
+	c, err := p.DeployABI(context.Background(), abi, wat(t, src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *c
+}
+
+// convWat returns a module following cc that exports concat, which
+// concatenates its two arguments, fail, which traps, and overflow, which
+// returns a result out of bounds. With separate
+// arguments and results in place there is no room for both arguments in the
+// first one, so concat writes the second argument over the first instead.
+// The module counts the calls to its dealloc in the frees global. Following
+// AssemblyScript, it also checks that __new allocates ArrayBuffers and counts
+// the regions pinned in the pins global.
+func convWat(cc CallConv) string {
+	allocParams := "(param $size i32)"
+	allocCheck, pin := "", ""
+	if cc.Alloc == AssemblyScriptConv.Alloc {
+		allocParams += " (param $id i32)"
+		allocCheck = "(if (i32.ne (local.get $id) (i32.const 1)) (then unreachable))"
+		pin = `(global $pins (export "pins") (mut i32) (i32.const 0))
+		(func (export "__pin") (param $ptr i32) (result i32)
+			(global.set $pins (i32.add (global.get $pins) (i32.const 1)))
+			(local.get $ptr))
+		(func (export "__unpin") (param $ptr i32)
+			(global.set $pins (i32.sub (global.get $pins) (i32.const 1))))`
+	}
+	dealloc := ""
+	if cc.Dealloc != "" {
+		params := "(param $ptr i32)"
+		if cc.Dealloc == RustDeallocConv.Dealloc {
+			params += " (param $size i32)"
+		}
+		dealloc = fmt.Sprintf(`(func (export %q) %s
+			(global.set $frees (i32.add (global.get $frees) (i32.const 1))))`, cc.Dealloc, params)
+	}
+
+	params := "(param $p i32) (param $a i32) (param $b i32)"
+	if cc.Args == ArgsSeparate {
+		params = "(param $p i32) (param $a i32) (param $q i32) (param $b i32)"
+	}
+	results := map[ResultMode]string{
+		ResultInPlace: "(result i32)",
+		ResultPair:    "(result i32 i32)",
+		ResultPacked:  "(result i64)",
+	}[cc.Result]
+
+	overflow := map[ResultMode]string{
+		ResultInPlace: "(i32.const 0x10000)",
+		ResultPair:    "(i32.const 0x10000) (i32.const 16)",
+		ResultPacked:  "(i64.const 0x1000000000010)",
+	}[cc.Result]
+
+	var body string
+	switch {
+	case cc.Result == ResultInPlace && cc.Args == ArgsLinear:
+		body = `(i32.add (local.get $a) (local.get $b))`
+	case cc.Result == ResultInPlace:
+		body = `(call $copy (local.get $p) (local.get $q) (local.get $b))
+			(local.get $b)`
+	default:
+		body = `(local.set $r (call $bump (i32.add (local.get $a) (local.get $b))))`
+		if cc.Args == ArgsLinear {
+			body += `(call $copy (local.get $r) (local.get $p) (i32.add (local.get $a) (local.get $b)))`
+		} else {
+			body += `(call $copy (local.get $r) (local.get $p) (local.get $a))
+				(call $copy (i32.add (local.get $r) (local.get $a)) (local.get $q) (local.get $b))`
+		}
+		if cc.Result == ResultPair {
+			body += `(local.get $r) (i32.add (local.get $a) (local.get $b))`
+		} else {
+			body += `(i64.or
+				(i64.shl (i64.extend_i32_u (local.get $r)) (i64.const 32))
+				(i64.extend_i32_u (i32.add (local.get $a) (local.get $b))))`
+		}
+	}
+
+	return fmt.Sprintf(`(module
+		(memory (export "memory") 1)
+		(global $heap (mut i32) (i32.const 1024))
+		(global $frees (export "frees") (mut i32) (i32.const 0))
+		(func $bump (param $size i32) (result i32)
+			(local $ptr i32)
+			(local.set $ptr (global.get $heap))
+			(global.set $heap (i32.add (global.get $heap) (local.get $size)))
+			(local.get $ptr))
+		(func $copy (param $dst i32) (param $src i32) (param $n i32)
+			(block $done
+				(loop $next
+					(br_if $done (i32.eqz (local.get $n)))
+					(i32.store8 (local.get $dst) (i32.load8_u (local.get $src)))
+					(local.set $dst (i32.add (local.get $dst) (i32.const 1)))
+					(local.set $src (i32.add (local.get $src) (i32.const 1)))
+					(local.set $n (i32.sub (local.get $n) (i32.const 1)))
+					(br $next))))
+		(func (export %q) %s (result i32)
+			%s
+			(call $bump (local.get $size)))
+		%s
+		%s
+		(func (export "concat") %s %s
+			(local $r i32)
+			%s)
+		(func (export "fail") %s %s
+			unreachable)
+		(func (export "overflow") %s %s
+			%s))`,
+		cc.Alloc, allocParams, allocCheck, dealloc, pin, params, results, body, params, results, params, results, overflow)
+}
+
+func TestCallConventions(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+
+	preset := func(name string) CallConv {
+		cc, err := CallConvByName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cc
+	}
+	convs := []struct {
+		name string
+		cc   CallConv
+		out  string
+	}{
+		{"rust", preset("rust"), "foobar"},
+		{"rust-dealloc", preset("rust-dealloc"), "foobar"},
+		{"tinygo", preset("tinygo"), "foobar"},
+		{"assemblyscript", preset("assemblyscript"), "foobar"},
+		{"c", preset("c"), "foobar"},
+		{"linear/pair", CallConv{Alloc: "alloc", Args: ArgsLinear, Result: ResultPair}, "foobar"},
+		{"linear/packed", CallConv{Alloc: "alloc", Args: ArgsLinear, Result: ResultPacked}, "foobar"},
+		{"separate/inplace", CallConv{Alloc: "alloc", Args: ArgsSeparate, Result: ResultInPlace}, "bar"},
+		{"separate/pair", CallConv{Alloc: "alloc", Dealloc: "dealloc", Args: ArgsSeparate, Result: ResultPair}, "foobar"},
+	}
+
+	for _, tc := range convs {
+		fn := deployWat(t, p, convWat(tc.cc), FxABI{Fxs: []string{"concat"}, Convention: tc.cc})
+		abi, err := p.GetABI(ctx, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := p.execute(ctx, abi, "concat", [][]byte{[]byte("foo"), []byte("bar")})
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if string(ex.output) != tc.out {
+			t.Errorf("%s: expected %q, got %q", tc.name, tc.out, ex.output)
+		}
+	}
+
+	if _, err := CallConvByName("fortran"); err == nil || !strings.Contains(err.Error(), "fortran") {
+		t.Errorf("unexpected error for an unknown convention: %v", err)
+	}
+}
+
+func TestGuestFree(t *testing.T) {
+	p := runtimePeer(t)
+	fn := deployWat(t, p, convWat(RustDeallocConv), FxABI{Fxs: []string{"concat"}, Convention: RustDeallocConv})
+	abi, err := p.GetABI(context.Background(), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, tree, done := p.callTree(context.Background())
+	defer done()
+
+	// Both arguments are released whatever happens, and the result too when
+	// there is one.
+	for fx, frees := range map[string]int32{"concat": 3, "fail": 2, "overflow": 2} {
+		instance, g, err := p.instantiate(ctx, tree, abi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := exportedFunc(instance, fx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = g.invoke(f, [][]byte{[]byte("foo"), []byte("bar")})
+		if (err == nil) != (fx == "concat") {
+			t.Errorf("%s: unexpected error %v", fx, err)
+		}
+		if n := instance.GetExport("frees").Global().Get().I32(); n != frees {
+			t.Errorf("%s: expected %d calls to dealloc, got %d", fx, frees, n)
+		}
+		if len(g.allocated) != 0 {
+			t.Errorf("%s: regions left allocated: %v", fx, g.allocated)
+		}
+	}
+}
+
+func TestGuestPin(t *testing.T) {
+	p := runtimePeer(t)
+	fn := deployWat(t, p, convWat(AssemblyScriptConv), FxABI{Fxs: []string{"concat"}, Convention: AssemblyScriptConv})
+	abi, err := p.GetABI(context.Background(), fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, tree, done := p.callTree(context.Background())
+	defer done()
+
+	for _, fx := range []string{"concat", "fail"} {
+		instance, g, err := p.instantiate(ctx, tree, abi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := exportedFunc(instance, fx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = g.invoke(f, [][]byte{[]byte("foo"), []byte("bar")}); (err == nil) != (fx == "concat") {
+			t.Errorf("%s: unexpected error %v", fx, err)
+		}
+		if n := instance.GetExport("pins").Global().Get().I32(); n != 0 {
+			t.Errorf("%s: %d regions left pinned", fx, n)
+		}
+	}
+}
+
+func TestCallConvDefaults(t *testing.T) {
+	if cc := (CallConv{}).withDefaults(); cc != RustConv {
+		t.Errorf("expected the Rust convention, got %+v", cc)
+	}
+	cc := CallConv{Alloc: "malloc", Result: ResultPacked}.withDefaults()
+	if cc.Alloc != "malloc" || cc.Args != ArgsLinear || cc.Result != ResultPacked {
+		t.Errorf("unexpected convention %+v", cc)
+	}
+}
@@ -0,0 +1,55 @@
+// The daemon runs a long-lived peer and serves its API on a Unix socket, so
+// scripts and terminals using the CLI share the same peer, datastore and
+// connections.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	ipfslite "github.com/adlrocha/ipfs-lite"
+)
+
+func main() {
+	repo := flag.String("repo", ipfslite.DefaultRepo, "directory of the datastore and identity of the peer")
+	api := flag.String("api", "", "address to serve the API at, unix:<repo>/api.sock by default")
+	listen := flag.String("listen", "/ip4/0.0.0.0/tcp/4005", "libp2p listen address")
+	offline := flag.Bool("offline", false, "don't connect to the network")
+	evalThunks := flag.Bool("eval-thunks", false, "evaluate the thunks requested through the API")
+	flag.Parse()
+	if *api == "" {
+		*api = ipfslite.DefaultAPIAddr(*repo)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, closer, err := ipfslite.OpenPeer(ctx, *repo, *listen, &ipfslite.Config{Offline: *offline, EvalThunks: *evalThunks})
+	if err != nil {
+		fmt.Println("Couldn't start peer: ", err)
+		os.Exit(1)
+	}
+
+	if err := ipfslite.NewCLI(p, os.Stdout).Run(ctx, []string{"id"}); err != nil {
+		os.Exit(1)
+	}
+	fmt.Println("API served at: ", *api)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+	err = p.ServeAPI(ctx, *api)
+	cancel()
+	closer.Close()
+	if err != nil {
+		fmt.Println("Couldn't serve API: ", err)
+		os.Exit(1)
+	}
+}
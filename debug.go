@@ -0,0 +1,169 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"debug/dwarf"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+)
+
+// Frame is a frame of the backtrace of a trap. File and Line are only set
+// in debug mode, when the module comes with DWARF debug info.
+type Frame struct {
+	FuncIndex    uint32
+	FuncName     string
+	FuncOffset   uint
+	ModuleOffset uint
+	File         string
+	Line         int
+}
+
+func (f Frame) String() string {
+	name := f.FuncName
+	if name == "" {
+		name = fmt.Sprintf("func[%d]", f.FuncIndex)
+	}
+	if f.File == "" {
+		return fmt.Sprintf("%s+%#x", name, f.FuncOffset)
+	}
+	return fmt.Sprintf("%s at %s:%d", name, f.File, f.Line)
+}
+
+// debugInfo maps offsets in the code of a module to source lines.
+type debugInfo struct {
+	data *dwarf.Data
+	// DWARF addresses are relative to the start of the code section.
+	codeOffset uint
+}
+
+// loadDebugInfo reads the DWARF sections of debug, which is either the
+// module itself or an unstripped build of it.
+func loadDebugInfo(module, debug []byte) (*debugInfo, error) {
+	di := &debugInfo{}
+	sections, err := wasmSections(module)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sections {
+		if s.id == wasmCodeSection {
+			di.codeOffset = uint(s.offset)
+		}
+	}
+
+	if debug != nil {
+		if sections, err = wasmSections(debug); err != nil {
+			return nil, err
+		}
+	}
+	dwarfSections := map[string][]byte{}
+	for _, s := range sections {
+		if s.id == wasmCustomSection && strings.HasPrefix(s.name, ".debug_") {
+			dwarfSections[s.name] = s.data
+		}
+	}
+	if dwarfSections[".debug_info"] == nil {
+		return nil, fmt.Errorf("module has no DWARF debug info")
+	}
+
+	di.data, err = dwarf.New(dwarfSections[".debug_abbrev"], dwarfSections[".debug_aranges"],
+		dwarfSections[".debug_frame"], dwarfSections[".debug_info"], dwarfSections[".debug_line"],
+		dwarfSections[".debug_pubnames"], dwarfSections[".debug_ranges"], dwarfSections[".debug_str"])
+	if err != nil {
+		return nil, err
+	}
+	// Sections added in DWARF 5.
+	for _, name := range []string{".debug_addr", ".debug_line_str", ".debug_loclists", ".debug_rnglists", ".debug_str_offsets"} {
+		if b, ok := dwarfSections[name]; ok {
+			if err := di.data.AddSection(name, b); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return di, nil
+}
+
+// lookup returns the source line of an offset in the module.
+func (di *debugInfo) lookup(moduleOffset uint) (string, int, bool) {
+	if moduleOffset < di.codeOffset {
+		return "", 0, false
+	}
+	pc := uint64(moduleOffset - di.codeOffset)
+
+	r := di.data.Reader()
+	for {
+		e, err := r.Next()
+		if err != nil || e == nil {
+			return "", 0, false
+		}
+		if e.Tag != dwarf.TagCompileUnit {
+			r.SkipChildren()
+			continue
+		}
+		ranges, err := di.data.Ranges(e)
+		if err != nil {
+			continue
+		}
+		for _, rg := range ranges {
+			if pc < rg[0] || pc >= rg[1] {
+				continue
+			}
+			lr, err := di.data.LineReader(e)
+			if err != nil || lr == nil {
+				return "", 0, false
+			}
+			le := dwarf.LineEntry{}
+			if err := lr.SeekPC(pc, &le); err != nil {
+				return "", 0, false
+			}
+			return le.File.Name, le.Line, true
+		}
+		r.SkipChildren()
+	}
+}
+
+// symbolize maps the backtrace of a trap to source lines, using the debug
+// info linked from the ABI or embedded in the module.
+func (p *Peer) symbolize(ctx context.Context, abi *FxABI, trap *TrapError) error {
+	module, err := p.fetch(ctx, abi.Bytecode)
+	if err != nil {
+		return err
+	}
+	var debug []byte
+	if abi.DebugInfo != nil {
+		if debug, err = p.fetch(ctx, *abi.DebugInfo); err != nil {
+			return err
+		}
+	}
+	di, err := loadDebugInfo(module, debug)
+	if err != nil {
+		return err
+	}
+	for i, f := range trap.Backtrace {
+		if file, line, ok := di.lookup(f.ModuleOffset); ok {
+			trap.Backtrace[i].File = file
+			trap.Backtrace[i].Line = line
+		}
+	}
+	return nil
+}
+
+// SetDebugInfo deploys a copy of the ABI of a function linking it to an
+// unstripped build of its bytecode, so backtraces can be mapped to source
+// lines without shipping the debug info with the bytecode. It returns the CID
+// of the new ABI.
+func (p *Peer) SetDebugInfo(ctx context.Context, fnCid cid.Cid, debug []byte) (*cid.Cid, error) {
+	abi, err := p.GetABI(ctx, fnCid)
+	if err != nil {
+		return nil, err
+	}
+	n, err := p.AddFile(ctx, bytes.NewReader(debug), &AddParams{})
+	if err != nil {
+		return nil, err
+	}
+	c := n.Cid()
+	abi.DebugInfo = &c
+	return p.putABI(ctx, abi)
+}
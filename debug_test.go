@@ -0,0 +1,166 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+func TestFrameString(t *testing.T) {
+	f := Frame{FuncIndex: 3, FuncOffset: 0x1a}
+	if s := f.String(); s != "func[3]+0x1a" {
+		t.Errorf("unexpected frame %q", s)
+	}
+	f.FuncName = "boom"
+	f.File = "src/lib.rs"
+	f.Line = 4
+	if s := f.String(); s != "boom at src/lib.rs:4" {
+		t.Errorf("unexpected frame %q", s)
+	}
+}
+
+func TestLoadDebugInfoWithoutDWARF(t *testing.T) {
+	module, err := wasmtime.Wat2Wasm(`(module (func (export "boom") unreachable))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadDebugInfo(module, nil); err == nil {
+		t.Error("expected an error for a module without debug info")
+	}
+}
+
+// withDWARF appends DWARF sections to a module, mapping its whole code
+// section to a line of file.
+func withDWARF(t *testing.T, module []byte, file string, line int) []byte {
+	t.Helper()
+	sections, err := wasmSections(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeSize := 0
+	for _, s := range sections {
+		if s.id == wasmCodeSection {
+			codeSize = len(s.data)
+		}
+	}
+
+	le := binary.LittleEndian
+	uleb := func(b *bytes.Buffer, v uint64) {
+		for {
+			c := byte(v & 0x7f)
+			v >>= 7
+			if v != 0 {
+				c |= 0x80
+			}
+			b.WriteByte(c)
+			if v == 0 {
+				return
+			}
+		}
+	}
+	u32 := func(v int) []byte {
+		b := make([]byte, 4)
+		le.PutUint32(b, uint32(v))
+		return b
+	}
+	// withLength prefixes a DWARF unit with its 32-bit length.
+	withLength := func(unit []byte) []byte {
+		return append(u32(len(unit)), unit...)
+	}
+
+	// A compile unit with a name, a line program and the range of the code.
+	abbrev := []byte{1, 0x11, 0, 0x03, 0x08, 0x10, 0x17, 0x11, 0x01, 0x12, 0x06, 0, 0, 0}
+	var info bytes.Buffer
+	info.Write([]byte{4, 0, 0, 0, 0, 0, 4, 1})
+	info.WriteString(file + "\x00")
+	info.Write(make([]byte, 8))
+	info.Write(u32(codeSize))
+
+	var header bytes.Buffer
+	header.Write([]byte{1, 1, 1, 0xfb, 14, 13, 0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1, 0})
+	header.WriteString(file + "\x00")
+	header.Write([]byte{0, 0, 0, 0})
+	var program bytes.Buffer
+	program.Write([]byte{0, 5, 2, 0, 0, 0, 0, 3})
+	program.WriteByte(byte(line-1) & 0x7f) // Lines below 64 fit in one SLEB128 byte.
+	program.Write([]byte{1, 2})
+	uleb(&program, uint64(codeSize))
+	program.Write([]byte{0, 1, 1})
+	lines := append([]byte{4, 0}, u32(header.Len())...)
+	lines = append(append(lines, header.Bytes()...), program.Bytes()...)
+
+	out := append([]byte(nil), module...)
+	for _, s := range []struct {
+		name string
+		data []byte
+	}{{".debug_abbrev", abbrev}, {".debug_info", withLength(info.Bytes())}, {".debug_line", withLength(lines)}} {
+		var content bytes.Buffer
+		uleb(&content, uint64(len(s.name)))
+		content.WriteString(s.name)
+		content.Write(s.data)
+		var section bytes.Buffer
+		section.WriteByte(wasmCustomSection)
+		uleb(&section, uint64(content.Len()))
+		section.Write(content.Bytes())
+		out = append(out, section.Bytes()...)
+	}
+	return out
+}
+
+func TestDebugInfo(t *testing.T) {
+	ctx := context.Background()
+	module := wat(t, `(module (func (export "boom") nop unreachable))`)
+	debug := withDWARF(t, module, "boom.c", 42)
+	sections, err := wasmSections(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codeOffset uint
+	for _, s := range sections {
+		if s.id == wasmCodeSection {
+			codeOffset = uint(s.offset)
+		}
+	}
+
+	// Debug info embedded in the module, or in a separate build.
+	for _, di := range [][2][]byte{{debug, nil}, {module, debug}} {
+		info, err := loadDebugInfo(di[0], di[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file, line, ok := info.lookup(codeOffset + 3); !ok || file != "boom.c" || line != 42 {
+			t.Errorf("expected boom.c:42, got %s:%d", file, line)
+		}
+		if _, _, ok := info.lookup(codeOffset - 1); ok {
+			t.Error("offsets before the code shouldn't map to a line")
+		}
+	}
+
+	// Traps of functions linking an unstripped build are symbolized.
+	p := dagPeer(t)
+	n, err := p.AddFile(ctx, bytes.NewReader(module), &AddParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, err := p.putABI(ctx, &FxABI{Fxs: []string{"boom"}, Bytecode: n.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fn, err = p.SetDebugInfo(ctx, *fn, debug); err != nil {
+		t.Fatal(err)
+	}
+	abi, err := p.GetABI(ctx, *fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trap := &TrapError{Backtrace: []Frame{{FuncName: "boom", ModuleOffset: codeOffset + 3}}}
+	if err := p.symbolize(ctx, abi, trap); err != nil {
+		t.Fatal(err)
+	}
+	if s := trap.Backtrace[0].String(); s != "boom at boom.c:42" {
+		t.Errorf("unexpected frame %q", s)
+	}
+}
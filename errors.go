@@ -0,0 +1,196 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/ipfs/go-cid"
+)
+
+// Errors returned by calls. They can be told apart with errors.As.
+
+// ABIError is returned when the ABI of a function can't be decoded.
+type ABIError struct {
+	Fn  cid.Cid
+	Err error
+}
+
+func (e *ABIError) Error() string {
+	return fmt.Sprintf("couldn't decode ABI %s: %s", e.Fn, e.Err)
+}
+
+func (e *ABIError) Unwrap() error { return e.Err }
+
+// FetchError is returned when some content can't be fetched.
+type FetchError struct {
+	Cid cid.Cid
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("couldn't fetch %s: %s", e.Cid, e.Err)
+}
+
+func (e *FetchError) Unwrap() error { return e.Err }
+
+// CompileError is returned when the bytecode of a function can't be
+// compiled.
+type CompileError struct {
+	Bytecode cid.Cid
+	Err      error
+}
+
+func (e *CompileError) Error() string {
+	return fmt.Sprintf("couldn't compile %s: %s", e.Bytecode, e.Err)
+}
+
+func (e *CompileError) Unwrap() error { return e.Err }
+
+// VerifyError is returned when running a function whose test vectors fail
+// on this runtime, if the peer verifies functions.
+type VerifyError struct {
+	Fn cid.Cid
+}
+
+func (e *VerifyError) Error() string {
+	return fmt.Sprintf("test vectors of %s fail on %s", e.Fn, RuntimeVersion)
+}
+
+// ExportError is returned when a module doesn't export something the runtime
+// needs.
+type ExportError struct {
+	Name string
+	Kind string // "function", "memory" or "global".
+}
+
+func (e *ExportError) Error() string {
+	return fmt.Sprintf("%s %s not exported by module", e.Kind, e.Name)
+}
+
+// Codes of the traps raised while running a function.
+const (
+	TrapUnreachable       = "unreachable"
+	TrapMemoryOutOfBounds = "memory out of bounds"
+	TrapTableOutOfBounds  = "table out of bounds"
+	TrapIndirectCall      = "indirect call"
+	TrapStackOverflow     = "stack overflow"
+	TrapIntegerOverflow   = "integer overflow"
+	TrapDivideByZero      = "integer divide by zero"
+	TrapBadConversion     = "invalid conversion to integer"
+	TrapInterrupt         = "interrupt"
+	TrapHost              = "host" // Raised by a host function.
+	TrapUnknown           = "unknown"
+)
+
+// trapCodes maps the messages of the traps raised by wasmtime to their code.
+// wasmtime-go doesn't expose trap codes yet.
+var trapCodes = map[string]string{
+	"unreachable":                                   TrapUnreachable,
+	"out of bounds memory access":                   TrapMemoryOutOfBounds,
+	"undefined element: out of bounds table access": TrapTableOutOfBounds,
+	"uninitialized element":                         TrapIndirectCall,
+	"indirect call type mismatch":                   TrapIndirectCall,
+	"call stack exhausted":                          TrapStackOverflow,
+	"integer overflow":                              TrapIntegerOverflow,
+	"integer divide by zero":                        TrapDivideByZero,
+	"invalid conversion to integer":                 TrapBadConversion,
+	"interrupt":                                     TrapInterrupt,
+}
+
+// TrapError is returned when a function traps. Code is one of the Trap
+// constants. When a host function made the function trap, Err is the error
+// it failed with and Cause its message, which is what remains of it once
+// encoded as JSON.
+type TrapError struct {
+	Code      string
+	Message   string
+	Backtrace []Frame // Innermost frame first.
+	Log       []byte  // What the function logged before trapping.
+	Cause     string  `json:",omitempty"`
+	Err       error   `json:"-"`
+}
+
+func (e *TrapError) Error() string {
+	return e.Message
+}
+
+func (e *TrapError) Unwrap() error { return e.Err }
+
+// Limits that can be exceeded by a call.
+const (
+	LimitCallDepth = "call depth"
+	LimitCalls     = "calls"
+	LimitCallTime  = "call time"
+	LimitMemory    = "memory"
+)
+
+// LimitError is returned when a call exceeds one of the limits of the peer.
+type LimitError struct {
+	Limit string
+	Max   string // e.g. "16" or "5m0s".
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("maximum %s of %s exceeded", e.Limit, e.Max)
+}
+
+// CycleError is returned when a function ends up calling itself with the
+// same arguments, which would never end.
+type CycleError struct {
+	Call string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("call cycle detected: %s", e.Call)
+}
+
+// BoundsError is returned when a function points to data outside of its
+// memory or the buffer reserved for it.
+type BoundsError struct {
+	Ptr   int32
+	Size  int32
+	Limit int // Size of the memory or buffer.
+}
+
+func (e *BoundsError) Error() string {
+	return fmt.Sprintf("region [%d, %d) out of bounds [0, %d)", e.Ptr, int(e.Ptr)+int(e.Size), e.Limit)
+}
+
+// callError turns the errors of calling into the guest into typed errors.
+// If the guest trapped because a nested call failed, the error of the nested
+// call is returned as it is.
+func (p *Peer) callError(ctx context.Context, err error) error {
+	var nested, host error
+	if tree, ok := ctx.Value(callTreeKey{}).(*callTree); ok {
+		nested, host = tree.takeError()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return &LimitError{Limit: LimitCallTime, Max: p.cfg.CallTimeout.String()}
+	}
+	trap, ok := err.(*wasmtime.Trap)
+	if !ok {
+		return err
+	}
+	if nested != nil {
+		return nested
+	}
+
+	e := &TrapError{Message: trap.Message(), Code: TrapUnknown}
+	if host != nil {
+		e.Code = TrapHost
+		e.Err = host
+		e.Cause = host.Error()
+	} else if code, ok := trapCodes[strings.SplitN(strings.TrimPrefix(e.Message, "wasm trap: "), "\n", 2)[0]]; ok {
+		e.Code = code
+	}
+	for _, f := range trap.Frames() {
+		frame := Frame{FuncIndex: f.FuncIndex(), FuncOffset: f.FuncOffset(), ModuleOffset: f.ModuleOffset()}
+		if n := f.FuncName(); n != nil {
+			frame.FuncName = *n
+		}
+		e.Backtrace = append(e.Backtrace, frame)
+	}
+	return e
+}
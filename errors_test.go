@@ -0,0 +1,65 @@
+package ipfslite
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+const errorsWat = `(module
+	(import "ipfs" "log" (func $log (param i32 i32 i32)))
+	(memory (export "memory") 1)
+	(func (export "alloc") (param $size i32) (result i32)
+		(i32.const 1024))
+	(func (export "fail") (param $p i32) (param $n i32) (result i32)
+		unreachable)
+	(func (export "div") (param $p i32) (param $n i32) (result i32)
+		(i32.div_u (local.get $n) (i32.sub (local.get $n) (local.get $n))))
+	(func (export "badlog") (param $p i32) (param $n i32) (result i32)
+		(call $log (i32.const 0) (i32.const 0x10000) (i32.const 16))
+		(local.get $n))
+	(func (export "overflow") (param $p i32) (param $n i32) (result i32)
+		(i32.const 0x10000))
+	(func (export "spin") (param $p i32) (param $n i32) (result i32)
+		(loop $forever
+			(br $forever))
+		(local.get $n)))`
+
+func TestCallErrors(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	p.cfg.CallTimeout = 200 * time.Millisecond
+	fn := deployWat(t, p, errorsWat, FxABI{Fxs: []string{"fail", "div", "badlog", "overflow", "spin"}})
+	abi, err := p.GetABI(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(fx string) error {
+		_, err := p.execute(ctx, abi, fx, [][]byte{[]byte("input")})
+		return err
+	}
+
+	for fx, code := range map[string]string{"fail": TrapUnreachable, "div": TrapDivideByZero} {
+		var trap *TrapError
+		if err := call(fx); !errors.As(err, &trap) || trap.Code != code {
+			t.Errorf("%s: expected a %s trap, got %v", fx, code, err)
+		}
+	}
+
+	var trap *TrapError
+	var bounds *BoundsError
+	err = call("badlog")
+	if !errors.As(err, &trap) || trap.Code != TrapHost || !errors.As(err, &bounds) {
+		t.Errorf("badlog: expected a host trap with a bounds error, got %v", err)
+	}
+
+	if err := call("overflow"); !errors.As(err, &bounds) {
+		t.Errorf("overflow: expected a bounds error, got %v", err)
+	}
+
+	var limit *LimitError
+	if err := call("spin"); !errors.As(err, &limit) || limit.Limit != LimitCallTime {
+		t.Errorf("spin: expected the call time to be exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,378 @@
+package ipfslite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Gateway returns an HTTP handler exposing the peer to services that don't
+// speak libp2p:
+//
+//	GET  /ipfs/<cid>  content of a file
+//	GET  /compute/<abiCid>/<fx>/<args>  output of a call, see GetPath
+//	POST /add         adds the body as a file
+//	POST /deploy      deploys the "bytecode" and "abi" parts of a multipart form
+//	POST /call        calls a function, taking a GatewayCall
+//	GET  /abi/<cid>   ABI of a function
+//
+// Except for /ipfs and /compute, responses are JSON. Errors are returned as a GatewayError
+// with a status code depending on the type of the error. Thunks requested
+// from /ipfs are only evaluated if the peer has Config.EvalThunks set, so
+// anyone reaching the gateway can run code on the peer in that case.
+func (p *Peer) Gateway() http.Handler {
+	return p.gatewayMux()
+}
+
+func (p *Peer) gatewayMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ipfs/", p.gatewayGet)
+	mux.HandleFunc(ComputePrefix, p.gatewayGet)
+	mux.HandleFunc("/add", p.gatewayAdd)
+	mux.HandleFunc("/deploy", p.gatewayDeploy)
+	mux.HandleFunc("/call", p.gatewayCall)
+	mux.HandleFunc("/abi/", p.gatewayABI)
+	return mux
+}
+
+// ServeGateway serves the gateway on addr until ctx is done.
+func (p *Peer) ServeGateway(ctx context.Context, addr string) error {
+	srv := &http.Server{Addr: addr, Handler: p.Gateway()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// GatewayCall is the body of calls to /call.
+type GatewayCall struct {
+	Fn   cid.Cid
+	Fx   string
+	Args []cid.Cid
+}
+
+// CallResult is the response of calls to /call.
+type CallResult struct {
+	Output  cid.Cid
+	Receipt cid.Cid
+	Log     *cid.Cid `json:",omitempty"`
+}
+
+func newCallResult(r *Receipt) (*CallResult, error) {
+	rc, err := receiptCid(r)
+	if err != nil {
+		return nil, err
+	}
+	return &CallResult{Output: r.Output, Receipt: rc, Log: r.Log}, nil
+}
+
+// GatewayError is the body of the responses of failed requests.
+type GatewayError struct {
+	Error string
+	// Kind of error, e.g. "trap" or "limit".
+	Kind string
+	// Details of traps, with the backtrace, what the function logged and the
+	// cause of traps raised by host functions.
+	Trap *TrapError `json:",omitempty"`
+}
+
+// errTooLarge is returned when the body of a request is larger than
+// Config.MaxUploadSize.
+type errTooLarge struct{ max int64 }
+
+func (e errTooLarge) Error() string {
+	return fmt.Sprintf("request body larger than %d bytes", e.max)
+}
+
+// errBadRequest marks errors in the requests themselves.
+type errBadRequest struct{ error }
+
+func badRequest(err error) error {
+	return errBadRequest{err}
+}
+
+// errorStatus maps the typed errors of the peer to HTTP status codes.
+func errorStatus(err error) (int, string) {
+	var (
+		badReq   errBadRequest
+		tooLarge errTooLarge
+		abiErr   *ABIError
+		fetchErr *FetchError
+		compErr  *CompileError
+		expErr   *ExportError
+		trapErr  *TrapError
+		limitErr *LimitError
+		cycleErr *CycleError
+		bndErr   *BoundsError
+		polErr   *PolicyError
+		schErr   *SchemaError
+		verErr   *VerifyError
+		apiErr   *APIError
+	)
+	switch {
+	case errors.As(err, &apiErr):
+		return apiErr.Status, apiErr.Kind
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, "request"
+	case errors.As(err, &badReq):
+		return http.StatusBadRequest, "request"
+	case err == ErrJobNotFound:
+		return http.StatusNotFound, "job"
+	case errors.As(err, &schErr):
+		return http.StatusBadRequest, "schema"
+	case errors.As(err, &polErr):
+		return http.StatusForbidden, "policy"
+	case errors.Is(err, ErrThunk):
+		return http.StatusForbidden, "thunk"
+	case errors.As(err, &verErr):
+		return http.StatusForbidden, "verify"
+	case errors.As(err, &limitErr):
+		if limitErr.Limit == LimitCallTime {
+			return http.StatusGatewayTimeout, "limit"
+		}
+		return http.StatusUnprocessableEntity, "limit"
+	case errors.As(err, &cycleErr):
+		return http.StatusLoopDetected, "cycle"
+	case errors.As(err, &abiErr):
+		return http.StatusUnprocessableEntity, "abi"
+	case errors.As(err, &compErr):
+		return http.StatusUnprocessableEntity, "compile"
+	case errors.As(err, &expErr):
+		return http.StatusUnprocessableEntity, "export"
+	case errors.As(err, &trapErr):
+		return http.StatusUnprocessableEntity, "trap"
+	case errors.As(err, &bndErr):
+		return http.StatusUnprocessableEntity, "bounds"
+	// Fetch errors come last as they wrap those of the thunks evaluated to
+	// get a file.
+	case errors.As(err, &fetchErr):
+		if errors.Is(err, context.DeadlineExceeded) {
+			return http.StatusGatewayTimeout, "fetch"
+		}
+		return http.StatusNotFound, "fetch"
+	case errors.Is(err, ipld.ErrNotFound):
+		return http.StatusNotFound, "fetch"
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error(err)
+	}
+}
+
+// newGatewayError describes an error for clients, with its status code.
+func newGatewayError(err error) (int, GatewayError) {
+	status, kind := errorStatus(err)
+	e := GatewayError{Error: err.Error(), Kind: kind}
+	errors.As(err, &e.Trap)
+	return status, e
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status, e := newGatewayError(err)
+	writeJSON(w, status, e)
+}
+
+// allowMethod checks the method of a request, answering it if it's wrong.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, GatewayError{Error: "method not allowed", Kind: "request"})
+	return false
+}
+
+// pathCid parses the CID following prefix in the path of a request.
+func pathCid(r *http.Request, prefix string) (cid.Cid, error) {
+	c, err := cid.Decode(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil {
+		return cid.Undef, badRequest(err)
+	}
+	return c, nil
+}
+
+// gatewayResolve returns the CID of the file requested from /ipfs or
+// /compute, calling the function of a compute path unless its output is
+// memoized.
+func (p *Peer) gatewayResolve(r *http.Request) (cid.Cid, error) {
+	if !strings.HasPrefix(r.URL.Path, ComputePrefix) {
+		return pathCid(r, "/ipfs/")
+	}
+	cp, err := ParseComputePath(r.URL.Path)
+	if err != nil {
+		return cid.Undef, badRequest(err)
+	}
+	out, err := p.CallMemoized(r.Context(), cp.Fn, cp.Fx, cp.Args)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return *out, nil
+}
+
+func (p *Peer) gatewayGet(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	c, err := p.gatewayResolve(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rsc, err := p.GetFile(r.Context(), c)
+	if err != nil {
+		writeError(w, &FetchError{Cid: c, Err: err})
+		return
+	}
+	defer rsc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Etag", `"`+c.String()+`"`)
+	http.ServeContent(w, r, "", time.Time{}, rsc)
+}
+
+func (p *Peer) gatewayAdd(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	body := p.limitUpload(w, r)
+	n, err := p.AddFile(r.Context(), r.Body, &AddParams{})
+	if err != nil {
+		writeError(w, body.err(err))
+		return
+	}
+	writeJSON(w, http.StatusCreated, struct{ Cid cid.Cid }{n.Cid()})
+}
+
+func (p *Peer) gatewayDeploy(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	body := p.limitUpload(w, r)
+	bytecode, err := formPart(r, "bytecode")
+	if err != nil {
+		writeError(w, body.err(err))
+		return
+	}
+	b, err := formPart(r, "abi")
+	if err != nil {
+		writeError(w, body.err(err))
+		return
+	}
+	abi := FxABI{}
+	if err := json.Unmarshal(b, &abi); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	c, err := p.DeployABI(r.Context(), abi, bytecode)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, struct{ Cid cid.Cid }{*c})
+}
+
+// uploadBody is the body of a request limited to Config.MaxUploadSize. It
+// tells when a request failed because it was larger.
+type uploadBody struct {
+	io.ReadCloser
+	max, read int64
+	exceeded  bool
+}
+
+// limitUpload limits the body of a request uploading content.
+func (p *Peer) limitUpload(w http.ResponseWriter, r *http.Request) *uploadBody {
+	b := &uploadBody{ReadCloser: http.MaxBytesReader(w, r.Body, p.cfg.MaxUploadSize), max: p.cfg.MaxUploadSize}
+	r.Body = b
+	return b
+}
+
+func (b *uploadBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	// MaxBytesReader only fails once the limit is reached.
+	if err != nil && err != io.EOF && b.read >= b.max {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// err returns the error of a request, which is an errTooLarge if the body
+// was larger than allowed.
+func (b *uploadBody) err(err error) error {
+	if b.exceeded {
+		return errTooLarge{b.max}
+	}
+	return err
+}
+
+// formPart reads a file or a value of a multipart form.
+func formPart(r *http.Request, name string) ([]byte, error) {
+	f, _, err := r.FormFile(name)
+	if err == http.ErrMissingFile {
+		if v := r.FormValue(name); v != "" {
+			return []byte(v), nil
+		}
+	}
+	if err != nil {
+		return nil, badRequest(err)
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func (p *Peer) gatewayCall(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	call := GatewayCall{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&call); err != nil {
+		writeError(w, badRequest(err))
+		return
+	}
+	receipt, err := p.CallReceipt(r.Context(), call.Fn, call.Fx, call.Args)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := newCallResult(receipt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (p *Peer) gatewayABI(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	c, err := pathCid(r, "/abi/")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	abi, err := p.GetABI(r.Context(), c)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, abi)
+}
@@ -0,0 +1,222 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestGateway(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+	srv := httptest.NewServer(p.Gateway())
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/add", "application/octet-stream", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := struct{ Cid cid.Cid }{}
+	if err := json.NewDecoder(res.Body).Decode(&added); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", res.StatusCode)
+	}
+
+	fn, err := p.putABI(ctx, &FxABI{Fxs: []string{"fx"}, Bytecode: added.Cid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		body         string
+	}{
+		{"GET", "/ipfs/" + added.Cid.String(), http.StatusOK, "hello"},
+		{"GET", "/ipfs/notacid", http.StatusBadRequest, ""},
+		{"GET", "/ipfs/" + missing.String(), http.StatusNotFound, ""},
+		{"POST", "/ipfs/" + added.Cid.String(), http.StatusMethodNotAllowed, ""},
+		{"GET", "/compute/" + fn.String(), http.StatusBadRequest, ""},
+		{"GET", "/compute/notacid/fx/", http.StatusBadRequest, ""},
+		{"GET", "/compute/" + fn.String() + "/fx/notacid", http.StatusBadRequest, ""},
+		{"GET", "/abi/" + fn.String(), http.StatusOK, ""},
+		{"GET", "/abi/" + added.Cid.String(), http.StatusUnprocessableEntity, ""},
+		{"POST", "/call", http.StatusBadRequest, ""},
+		{"POST", "/deploy", http.StatusBadRequest, ""},
+	} {
+		req, _ := http.NewRequest(tc.method, srv.URL+tc.path, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%s %s: expected %d, got %d: %s", tc.method, tc.path, tc.status, res.StatusCode, b)
+		}
+		if tc.body != "" && string(b) != tc.body {
+			t.Errorf("%s %s: expected %q, got %q", tc.method, tc.path, tc.body, b)
+		}
+	}
+}
+
+func TestGatewayCall(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	p.cfg.EvalThunks = true
+	srv := httptest.NewServer(p.Gateway())
+	defer srv.Close()
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("bytecode", "concat.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(wat(t, convWat(RustConv)))
+	form.WriteField("abi", `{"Fxs": ["concat", "fail"]}`)
+	form.Close()
+	res, err := http.Post(srv.URL+"/deploy", form.FormDataContentType(), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployed := struct{ Cid cid.Cid }{}
+	if err := json.NewDecoder(res.Body).Decode(&deployed); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", res.StatusCode)
+	}
+
+	var args []cid.Cid
+	for _, s := range []string{"foo", "bar"} {
+		n, err := p.AddFile(ctx, bytes.NewReader([]byte(s)), &AddParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, n.Cid())
+	}
+	b, _ := json.Marshal(GatewayCall{Fn: deployed.Cid, Fx: "concat", Args: args})
+	res, err = http.Post(srv.URL+"/call", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := CallResult{}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", res.StatusCode)
+	}
+
+	// A thunk that traps is answered as a trap, not as a missing file.
+	thunk, err := p.NewThunk(ctx, deployed.Cid, "fail", args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/ipfs/" + result.Output.String(), http.StatusOK, "foobar"},
+		{"/compute/" + deployed.Cid.String() + "/concat/" + args[0].String() + "," + args[1].String(), http.StatusOK, "foobar"},
+		{"/ipfs/" + thunk.String(), http.StatusUnprocessableEntity, ""},
+	} {
+		res, err := http.Get(srv.URL + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("GET %s: expected %d, got %d: %s", tc.path, tc.status, res.StatusCode, b)
+		}
+		if tc.body != "" && string(b) != tc.body {
+			t.Errorf("GET %s: expected %q, got %q", tc.path, tc.body, b)
+		}
+	}
+}
+
+func TestGatewayUploadSize(t *testing.T) {
+	p := dagPeer(t)
+	p.cfg.MaxUploadSize = 64
+	srv := httptest.NewServer(p.Gateway())
+	defer srv.Close()
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	form.WriteField("bytecode", string(bytes.Repeat([]byte("x"), 100)))
+	form.WriteField("abi", `{"Fxs": ["fx"]}`)
+	form.Close()
+
+	for _, tc := range []struct {
+		path, contentType string
+		body              []byte
+		status            int
+	}{
+		{"/add", "application/octet-stream", []byte("small"), http.StatusCreated},
+		{"/add", "application/octet-stream", bytes.Repeat([]byte("x"), 100), http.StatusRequestEntityTooLarge},
+		{"/deploy", form.FormDataContentType(), body.Bytes(), http.StatusRequestEntityTooLarge},
+	} {
+		res, err := http.Post(srv.URL+tc.path, tc.contentType, bytes.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tc.status {
+			t.Errorf("%s of %d bytes: expected %d, got %d: %s", tc.path, len(tc.body), tc.status, res.StatusCode, b)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	for err, want := range map[error]int{
+		&FetchError{Err: context.DeadlineExceeded}:           http.StatusGatewayTimeout,
+		&FetchError{Err: errors.New("not found")}:            http.StatusNotFound,
+		&TrapError{Code: TrapUnreachable}:                    http.StatusUnprocessableEntity,
+		&FetchError{Err: &TrapError{Code: TrapUnreachable}}:  http.StatusUnprocessableEntity,
+		&FetchError{Err: &CycleError{}}:                      http.StatusLoopDetected,
+		&LimitError{Limit: LimitCallTime}:                    http.StatusGatewayTimeout,
+		&LimitError{Limit: LimitCalls}:                       http.StatusUnprocessableEntity,
+		&CycleError{}:                                        http.StatusLoopDetected,
+		&PolicyError{}:                                       http.StatusForbidden,
+		fmt.Errorf("invalid argument 0: %w", &SchemaError{}): http.StatusBadRequest,
+		errors.New("disk full"):                              http.StatusInternalServerError,
+	} {
+		if status, _ := errorStatus(err); status != want {
+			t.Errorf("%v: expected %d, got %d", err, want, status)
+		}
+	}
+}
+
+func TestGatewayErrorJSON(t *testing.T) {
+	bounds := &BoundsError{Ptr: 0x10000, Size: 16, Limit: 0x10000}
+	b, err := json.Marshal(GatewayError{Error: "trap", Kind: "trap", Trap: &TrapError{Code: TrapHost, Cause: bounds.Error(), Err: bounds}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ge := GatewayError{}
+	if err := json.Unmarshal(b, &ge); err != nil {
+		t.Fatal(err)
+	}
+	if ge.Trap == nil || ge.Trap.Cause != bounds.Error() {
+		t.Errorf("expected the cause of the trap, got %s", b)
+	}
+}
@@ -0,0 +1,78 @@
+package ipfslite
+
+import (
+	"context"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// gossipSub adapts go-libp2p-pubsub to the PubSub interface.
+type gossipSub struct {
+	ps *pubsub.PubSub
+
+	lk     sync.Mutex
+	topics map[string]*pubsub.Topic
+}
+
+// NewGossipSub starts a gossipsub router on the host for the workers of a
+// Peer. Set it as Config.PubSub.
+func NewGossipSub(ctx context.Context, h host.Host) (PubSub, error) {
+	ps, err := pubsub.NewGossipSub(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	return &gossipSub{ps: ps, topics: make(map[string]*pubsub.Topic)}, nil
+}
+
+// topic joins a topic once, as joining it twice fails.
+func (g *gossipSub) topic(name string) (*pubsub.Topic, error) {
+	g.lk.Lock()
+	defer g.lk.Unlock()
+	if t, ok := g.topics[name]; ok {
+		return t, nil
+	}
+	t, err := g.ps.Join(name)
+	if err != nil {
+		return nil, err
+	}
+	g.topics[name] = t
+	return t, nil
+}
+
+func (g *gossipSub) Publish(ctx context.Context, topic string, data []byte) error {
+	t, err := g.topic(topic)
+	if err != nil {
+		return err
+	}
+	return t.Publish(ctx, data)
+}
+
+func (g *gossipSub) Subscribe(topic string) (Subscription, error) {
+	t, err := g.topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := t.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+	return &gossipSubscription{sub}, nil
+}
+
+type gossipSubscription struct {
+	sub *pubsub.Subscription
+}
+
+func (s *gossipSubscription) Next(ctx context.Context) (*PubSubMessage, error) {
+	m, err := s.sub.Next(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &PubSubMessage{From: m.GetFrom(), Data: m.Data}, nil
+}
+
+func (s *gossipSubscription) Cancel() {
+	s.sub.Cancel()
+}
@@ -0,0 +1,23 @@
+package ipfslite
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+)
+
+func TestCallPoolGossipSub(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	peers := newPoolPeers(t, ctx, 3, func(h host.Host) PubSub {
+		ps, err := NewGossipSub(ctx, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ps
+	})
+	// Subscriptions take a round trip to reach the other peers.
+	testCallPool(t, ctx, peers, time.Second)
+}
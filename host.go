@@ -0,0 +1,142 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/ipfs/go-cid"
+)
+
+// HostModule is the name of the module from which guests import the
+// functions provided by the host.
+const HostModule = "ipfs"
+
+// defineHostFuncs adds the host functions to the linker used to instantiate
+// a module.
+func (p *Peer) defineHostFuncs(ctx context.Context, tree *callTree, linker *wasmtime.Linker, logs *callLog) error {
+	// log(level, ptr, len)
+	//
+	// Adds a message to the log of the call.
+	err := linker.DefineFunc(HostModule, "log", func(caller *wasmtime.Caller, level, ptr, size int32) *wasmtime.Trap {
+		mem, trap := p.hostMemory(tree, caller)
+		if trap != nil {
+			return trap
+		}
+		msg, err := readString(mem, ptr, size)
+		if err != nil {
+			return tree.trap(err)
+		}
+		if p.cfg.TraceHostCalls {
+			logs.write("trace", []byte(fmt.Sprintf("%s.log(%d, %q)", HostModule, level, msg)))
+		}
+		prefix := fmt.Sprintf("level %d", level)
+		if level >= 0 && int(level) < len(logLevels) {
+			prefix = logLevels[level]
+		}
+		logs.write(prefix, []byte(msg))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// call(fn_ptr, fn_len, fx_ptr, fx_len, args_ptr, args_len, out_ptr, out_cap) -> out_len
+	//
+	// Calls fx from the function deployed at fn with the comma-separated
+	// list of argument CIDs in args. The output CID is written to out as a
+	// string and its length is returned.
+	return linker.DefineFunc(HostModule, "call", func(caller *wasmtime.Caller,
+		fnPtr, fnLen, fxPtr, fxLen, argsPtr, argsLen, outPtr, outCap int32) (int32, *wasmtime.Trap) {
+
+		trap := func(err error) (int32, *wasmtime.Trap) {
+			return 0, tree.trap(err)
+		}
+
+		mem, memTrap := p.hostMemory(tree, caller)
+		if memTrap != nil {
+			return 0, memTrap
+		}
+		fn, err := readString(mem, fnPtr, fnLen)
+		if err != nil {
+			return trap(err)
+		}
+		fx, err := readString(mem, fxPtr, fxLen)
+		if err != nil {
+			return trap(err)
+		}
+		argsIn, err := readString(mem, argsPtr, argsLen)
+		if err != nil {
+			return trap(err)
+		}
+
+		fnCid, err := cid.Decode(fn)
+		if err != nil {
+			return trap(err)
+		}
+		args := []cid.Cid{}
+		if argsIn != "" {
+			for _, cs := range strings.Split(argsIn, ",") {
+				c, err := cid.Decode(cs)
+				if err != nil {
+					return trap(err)
+				}
+				args = append(args, c)
+			}
+		}
+
+		out, err := p.Call(ctx, fnCid, fx, args)
+		if p.cfg.TraceHostCalls {
+			res := fmt.Sprintf("error: %s", err)
+			if err == nil {
+				res = out.String()
+			}
+			logs.write("trace", []byte(fmt.Sprintf("%s.call(%s, %q, [%s]) -> %s", HostModule, fnCid, fx, cidsString(args), res)))
+		}
+		if err != nil {
+			return 0, tree.fail(err)
+		}
+
+		outStr := out.String()
+		if int32(len(outStr)) > outCap {
+			return trap(fmt.Errorf("output buffer of %d bytes can't fit CID of %d bytes", outCap, len(outStr)))
+		}
+		// Memory may have grown during the nested call.
+		buf := mem.UnsafeData()
+		if outPtr < 0 || int(outPtr)+len(outStr) > len(buf) {
+			return trap(&BoundsError{Ptr: outPtr, Size: int32(len(outStr)), Limit: len(buf)})
+		}
+		copy(buf[outPtr:], outStr)
+		return int32(len(outStr)), nil
+	})
+}
+
+// hostMemory returns the memory of the guest calling a host function, or the
+// trap to raise if it has none or it grew past the limit of the policy.
+func (p *Peer) hostMemory(tree *callTree, caller *wasmtime.Caller) (*wasmtime.Memory, *wasmtime.Trap) {
+	mem := callerMemory(caller)
+	if mem == nil {
+		return nil, tree.trap(&ExportError{Name: "memory", Kind: "memory"})
+	}
+	if err := memoryLimit(mem, p.cfg.Policy.MaxMemoryPages); err != nil {
+		return nil, tree.fail(err)
+	}
+	return mem, nil
+}
+
+func callerMemory(caller *wasmtime.Caller) *wasmtime.Memory {
+	ext := caller.GetExport("memory")
+	if ext == nil {
+		return nil
+	}
+	return ext.Memory()
+}
+
+func readString(mem *wasmtime.Memory, ptr, size int32) (string, error) {
+	buf := mem.UnsafeData()
+	if ptr < 0 || size < 0 || int(ptr)+int(size) > len(buf) {
+		return "", &BoundsError{Ptr: ptr, Size: size, Limit: len(buf)}
+	}
+	return string(buf[ptr : ptr+size]), nil
+}
@@ -45,6 +45,18 @@ var logger = logging.Logger("ipfslite")
 
 var (
 	defaultReprovideInterval = 12 * time.Hour
+	defaultMaxCallDepth      = 16
+	defaultMaxCalls          = 256
+	defaultMaxRecursion      = 8
+	defaultCallTimeout       = 5 * time.Minute
+	defaultMaxSteps          = 1000
+	defaultMaxLogSize        = 64 << 10
+	defaultMaxModules        = 64
+	defaultMaxUploadSize     = int64(64 << 20)
+	defaultWorkers           = 4
+	defaultMaxAttempts       = 5
+	defaultRetryBackoff      = 30 * time.Second
+	defaultLeaseTime         = 30 * time.Second
 )
 
 // Config wraps configuration options for the Peer.
@@ -53,12 +65,97 @@ type Config struct {
 	Offline bool
 	// ReprovideInterval sets how often to reprovide records to the DHT
 	ReprovideInterval time.Duration
+	// MaxCallDepth limits how deep functions can nest calls to other functions
+	MaxCallDepth int
+	// MaxCalls limits the number of calls triggered by a single call
+	MaxCalls int
+	// MaxRecursion limits how many calls to the same function can be running
+	// at once in a call tree, so functions calling each other with changing
+	// arguments are stopped as a cycle
+	MaxRecursion int
+	// CallTimeout limits how long a call, including its nested calls, can run
+	CallTimeout time.Duration
+	// MaxSteps limits the steps a resumable call runs before being checkpointed
+	MaxSteps int
+	// MaxModules limits the compiled modules kept in memory, evicting the
+	// least recently used ones
+	MaxModules int
+	// Policy restricts the modules that can be deployed and run
+	Policy *Policy
+	// VerifyFunctions refuses to run functions whose test vectors fail
+	VerifyFunctions bool
+	// MaxLogSize limits the size of the log kept for each call
+	MaxLogSize int
+	// MaxUploadSize limits the size of the content added and the functions
+	// deployed through the gateway
+	MaxUploadSize int64
+	// Debug maps the backtraces of traps to source lines using DWARF
+	Debug bool
+	// TraceHostCalls logs every call to a host function with its arguments,
+	// including the WASI functions allowed by the default policy
+	TraceHostCalls bool
+	// EvalThunks lets GetFile, and so Call and the gateway, evaluate the
+	// thunks they meet. Thunks run arbitrary code, so otherwise they are
+	// only evaluated with Force
+	EvalThunks bool
+	// Workers sets how many submitted calls run at the same time
+	Workers int
+	// MaxAttempts limits how many times a submitted call is tried when it
+	// fails for transient reasons, like fetches timing out
+	MaxAttempts int
+	// RetryBackoff is the delay before the first retry of a submitted call,
+	// doubled after each attempt
+	RetryBackoff time.Duration
+	// PubSub is the router used to exchange jobs with pools of workers
+	PubSub PubSub
+	// LeaseTime is how long a worker holds a job of a pool without renewing
+	// its lease
+	LeaseTime time.Duration
 }
 
 func (cfg *Config) setDefaults() {
 	if cfg.ReprovideInterval == 0 {
 		cfg.ReprovideInterval = defaultReprovideInterval
 	}
+	if cfg.MaxCallDepth == 0 {
+		cfg.MaxCallDepth = defaultMaxCallDepth
+	}
+	if cfg.MaxCalls == 0 {
+		cfg.MaxCalls = defaultMaxCalls
+	}
+	if cfg.MaxRecursion == 0 {
+		cfg.MaxRecursion = defaultMaxRecursion
+	}
+	if cfg.CallTimeout == 0 {
+		cfg.CallTimeout = defaultCallTimeout
+	}
+	if cfg.MaxSteps == 0 {
+		cfg.MaxSteps = defaultMaxSteps
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = defaultWorkers
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = defaultMaxAttempts
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = defaultRetryBackoff
+	}
+	if cfg.LeaseTime == 0 {
+		cfg.LeaseTime = defaultLeaseTime
+	}
+	if cfg.MaxLogSize == 0 {
+		cfg.MaxLogSize = defaultMaxLogSize
+	}
+	if cfg.MaxModules == 0 {
+		cfg.MaxModules = defaultMaxModules
+	}
+	if cfg.MaxUploadSize == 0 {
+		cfg.MaxUploadSize = defaultMaxUploadSize
+	}
+	if cfg.Policy == nil {
+		cfg.Policy = DefaultPolicy()
+	}
 }
 
 // Peer is an IPFS-Lite peer. It provides a DAG service that can fetch and put
@@ -77,7 +174,11 @@ type Peer struct {
 	bserv           blockservice.BlockService
 	reprovider      provider.System
 
+	engine  *wasmtime.Engine
 	runtime *wasmtime.Store
+	modules moduleCache
+	actors  actorLocks
+	jobs    *jobQueue
 }
 
 // New creates an IPFS-Lite Peer. It uses the given datastore, libp2p Host and
@@ -126,6 +227,11 @@ func New(
 	}
 
 	p.setupRuntime()
+	err = p.startJobs()
+	if err != nil {
+		p.bserv.Close()
+		return nil, err
+	}
 
 	go p.autoclose()
 
@@ -133,7 +239,16 @@ func New(
 }
 
 func (p *Peer) setupRuntime() {
-	p.runtime = wasmtime.NewStore(wasmtime.NewEngine())
+	cfg := wasmtime.NewConfig()
+	// Needed to stop calls once they time out.
+	cfg.SetInterruptable(true)
+	cfg.SetDebugInfo(p.cfg.Debug)
+	// The policy decides which modules can use them.
+	cfg.SetWasmThreads(true)
+	cfg.SetWasmSIMD(true)
+	p.engine = wasmtime.NewEngineWithConfig(cfg)
+	p.runtime = wasmtime.NewStore(p.engine)
+	p.modules.max = p.cfg.MaxModules
 }
 
 // Runtime return the peer's WASM runtime
@@ -328,12 +443,28 @@ func (p *Peer) AddFile(ctx context.Context, r io.Reader, params *AddParams) (ipl
 }
 
 // GetFile returns a reader to a file as identified by its root CID. The file
-// must have been added as a UnixFS DAG (default for IPFS).
+// must have been added as a UnixFS DAG (default for IPFS). If the CID is a
+// thunk and Config.EvalThunks is set, or it is being forced, the thunk is
+// evaluated and the reader points to its output. Otherwise an error wrapping
+// ErrThunk is returned.
 func (p *Peer) GetFile(ctx context.Context, c cid.Cid) (ufsio.ReadSeekCloser, error) {
 	n, err := p.Get(ctx, c)
 	if err != nil {
 		return nil, err
 	}
+	if t, ok := asThunk(n); ok {
+		if !p.cfg.EvalThunks && !forcing(ctx) {
+			return nil, fmt.Errorf("%s: %w", c, ErrThunk)
+		}
+		out, err := p.evalThunk(ctx, c, t)
+		if err != nil {
+			return nil, err
+		}
+		n, err = p.Get(ctx, *out)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return ufsio.NewDagReader(ctx, n, p)
 }
 
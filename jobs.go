@@ -0,0 +1,540 @@
+package ipfslite
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/namespace"
+	"github.com/ipfs/go-datastore/query"
+	ipld "github.com/ipfs/go-ipld-format"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+var (
+	jobsKey     = datastore.NewKey("/jobs")
+	jobQueueKey = datastore.NewKey("/queue/jobs")
+)
+
+// JobState is the state of a submitted call.
+type JobState string
+
+// States of a job.
+const (
+	JobQueued   JobState = "queued"
+	JobFetching JobState = "fetching"
+	JobRunning  JobState = "running"
+	JobRetrying JobState = "retrying"
+	JobDone     JobState = "done"
+	JobFailed   JobState = "failed"
+	JobCanceled JobState = "canceled"
+)
+
+// Finished is true when the job won't change anymore.
+func (s JobState) Finished() bool {
+	return s == JobDone || s == JobFailed || s == JobCanceled
+}
+
+// ErrJobNotFound is returned for unknown job IDs.
+var ErrJobNotFound = errors.New("job not found")
+
+var errJobCanceled = errors.New("job canceled")
+
+// Job is a call submitted to run in the background. Jobs are stored in the
+// datastore, so they survive restarts.
+type Job struct {
+	ID   string
+	Fn   cid.Cid
+	Fx   string
+	Args []cid.Cid
+
+	State   JobState
+	Output  *cid.Cid `json:",omitempty"`
+	Receipt *cid.Cid `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+	Updated int64    // Unix timestamp of the last state change.
+
+	Attempts    int
+	NextAttempt int64 `json:",omitempty"` // Unix timestamp of the next retry.
+	// Transient is set when the job failed for reasons that may go away,
+	// like a fetch timing out, after running out of attempts. Jobs failing
+	// deterministically, e.g. because the function trapped, are never
+	// retried.
+	Transient bool `json:",omitempty"`
+	// Worker is the peer that ran a job submitted to a pool.
+	Worker peer.ID `json:",omitempty"`
+}
+
+// jobQueue holds the jobs waiting for a worker and the ones running.
+type jobQueue struct {
+	// Serializes the updates of jobs in the datastore.
+	update sync.Mutex
+
+	// Jobs waiting for a worker. Like the queue of go-ipfs-provider, entries
+	// are keyed by time so they come out of the datastore in order, but the
+	// time is when the job is due to run, which is later for retries.
+	ds datastore.Datastore
+
+	lk     sync.Mutex
+	signal chan struct{}
+	cancel map[string]context.CancelFunc
+	done   map[string]chan struct{}
+}
+
+func newJobQueue(ds datastore.Datastore) *jobQueue {
+	return &jobQueue{
+		ds:     namespace.Wrap(ds, jobQueueKey),
+		signal: make(chan struct{}, 1),
+		cancel: make(map[string]context.CancelFunc),
+		done:   make(map[string]chan struct{}),
+	}
+}
+
+// push queues a job to run once at is reached.
+func (q *jobQueue) push(id string, at time.Time) error {
+	// Pad the time so keys sort in time order.
+	k := datastore.NewKey(fmt.Sprintf("%020d/%s", at.UnixNano(), id))
+	q.lk.Lock()
+	err := q.ds.Put(k, []byte(id))
+	if err == nil {
+		q.wait(id)
+	}
+	q.lk.Unlock()
+	if err != nil {
+		return err
+	}
+	q.wake()
+	return nil
+}
+
+// wait registers a job that can be waited for. q.lk must be held.
+func (q *jobQueue) wait(id string) {
+	if _, ok := q.done[id]; !ok {
+		q.done[id] = make(chan struct{})
+	}
+}
+
+func (q *jobQueue) wake() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// next waits for a job that is due.
+func (q *jobQueue) next(ctx context.Context) (string, bool) {
+	for {
+		q.lk.Lock()
+		id, wait, err := q.pop()
+		q.lk.Unlock()
+		if err != nil {
+			logger.Errorf("error reading job queue: %s", err)
+			return "", false
+		}
+		if id != "" {
+			// Wake up another worker in case more jobs are due.
+			q.wake()
+			return id, true
+		}
+
+		if wait == 0 {
+			// Nothing queued, wait for a push.
+			wait = time.Hour
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-q.signal:
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return "", false
+		}
+		t.Stop()
+	}
+}
+
+// pop removes the first job of the queue if it is due. Otherwise it returns
+// how long until it is, or zero if the queue is empty. q.lk must be held.
+func (q *jobQueue) pop() (string, time.Duration, error) {
+	for {
+		res, err := q.ds.Query(query.Query{Orders: []query.Order{query.OrderByKey{}}, Limit: 1})
+		if err != nil {
+			return "", 0, err
+		}
+		r, ok := res.NextSync()
+		res.Close()
+		if !ok {
+			return "", 0, nil
+		}
+		if r.Error != nil {
+			return "", 0, r.Error
+		}
+
+		k := datastore.NewKey(r.Key)
+		due, err := strconv.ParseInt(k.Namespaces()[0], 10, 64)
+		if err != nil {
+			logger.Warningf("removing invalid job queue entry %s: %s", k, err)
+			if err := q.ds.Delete(k); err != nil {
+				return "", 0, err
+			}
+			continue
+		}
+		if wait := time.Until(time.Unix(0, due)); wait > 0 {
+			return "", wait, nil
+		}
+		if err := q.ds.Delete(k); err != nil {
+			return "", 0, err
+		}
+		return string(r.Value), 0, nil
+	}
+}
+
+// queued returns the IDs of the jobs in the queue.
+func (q *jobQueue) queued() (map[string]bool, error) {
+	res, err := q.ds.Query(query.Query{})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, e := range entries {
+		ids[string(e.Value)] = true
+	}
+	return ids, nil
+}
+
+// finish wakes up whoever is waiting for a job.
+func (q *jobQueue) finish(id string) {
+	q.lk.Lock()
+	defer q.lk.Unlock()
+	if done, ok := q.done[id]; ok {
+		close(done)
+		delete(q.done, id)
+	}
+}
+
+// startJobs starts the workers and queues again the jobs that were running
+// when the peer was last stopped. Queued jobs and retries stay in the queue.
+func (p *Peer) startJobs() error {
+	p.jobs = newJobQueue(p.store)
+	queued, err := p.jobs.queued()
+	if err != nil {
+		return err
+	}
+
+	res, err := p.store.Query(query.Query{Prefix: jobsKey.String()})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		job := &Job{}
+		if err := json.Unmarshal(e.Value, job); err != nil {
+			return err
+		}
+		if job.State.Finished() {
+			continue
+		}
+		if queued[job.ID] {
+			p.jobs.wait(job.ID)
+			continue
+		}
+		job.State = JobQueued
+		if err := p.putJob(job); err != nil {
+			return err
+		}
+		if err := p.jobs.push(job.ID, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < p.cfg.Workers; i++ {
+		go p.jobWorker()
+	}
+	return nil
+}
+
+func (p *Peer) jobWorker() {
+	for {
+		id, ok := p.jobs.next(p.ctx)
+		if !ok {
+			return
+		}
+		if err := p.runJob(id); err != nil {
+			logger.Errorf("job %s: %s", id, err)
+		}
+	}
+}
+
+// runJob fetches the inputs of a job and runs it. Jobs failing for transient
+// reasons are queued again with exponential backoff until they run out of
+// attempts.
+func (p *Peer) runJob(id string) error {
+	job, err := p.Status(id)
+	if err != nil {
+		return err
+	}
+	if job.State.Finished() {
+		// Canceled while queued.
+		p.jobs.finish(id)
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(p.ctx)
+	defer cancel()
+	p.jobs.lk.Lock()
+	p.jobs.cancel[id] = cancel
+	p.jobs.lk.Unlock()
+
+	err = p.updateJob(id, func(job *Job) {
+		job.State = JobFetching
+		job.Attempts++
+	})
+	if err == nil {
+		// Don't wait forever for unresponsive providers.
+		fetchCtx, cancel := context.WithTimeout(ctx, p.cfg.CallTimeout)
+		err = p.prefetch(fetchCtx, job)
+		cancel()
+	}
+	if err == nil {
+		err = p.updateJob(id, func(job *Job) { job.State = JobRunning })
+	}
+	var r *Receipt
+	var rc cid.Cid
+	if err == nil {
+		r, err = p.CallReceipt(ctx, job.Fn, job.Fx, job.Args)
+	}
+	if err == nil {
+		rc, err = receiptCid(r)
+	}
+
+	p.jobs.lk.Lock()
+	delete(p.jobs.cancel, id)
+	p.jobs.lk.Unlock()
+
+	if p.ctx.Err() != nil {
+		// The peer is stopping. The job runs again once it restarts.
+		return nil
+	}
+
+	var retry time.Time
+	updateErr := p.updateJob(id, func(job *Job) {
+		switch {
+		case err == nil:
+			job.State = JobDone
+			job.Output = &r.Output
+			job.Receipt = &rc
+			job.Error = ""
+			job.NextAttempt = 0
+		case transient(err) && job.Attempts < p.cfg.MaxAttempts:
+			retry = time.Now().Add(p.cfg.RetryBackoff << uint(job.Attempts-1))
+			job.State = JobRetrying
+			job.Error = err.Error()
+			job.NextAttempt = retry.Unix()
+		default:
+			job.State = JobFailed
+			job.Error = err.Error()
+			job.NextAttempt = 0
+			job.Transient = transient(err)
+		}
+	})
+	if updateErr == nil && !retry.IsZero() {
+		return p.jobs.push(id, retry)
+	}
+	p.jobs.finish(id)
+	if updateErr == errJobCanceled {
+		return nil
+	}
+	return updateErr
+}
+
+// transient tells whether a job failing with err may succeed if retried.
+// Only fetches that didn't find the content or timed out are retried.
+// Anything else, like traps, policy rejections, invalid arguments or thunk
+// arguments failing to evaluate, would fail the same way again.
+func transient(err error) bool {
+	var timeout errPrefetchTimeout
+	if errors.As(err, &timeout) {
+		return true
+	}
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) {
+		return false
+	}
+	return errors.Is(fetchErr.Err, ipld.ErrNotFound) || errors.Is(fetchErr.Err, context.DeadlineExceeded)
+}
+
+// errPrefetchTimeout marks the errors of prefetches that ran out of time.
+// Online, bitswap waits for providers until the deadline instead of telling
+// that the content wasn't found, and the DAG service doesn't wrap the
+// context error, so timeouts are told from the context of the prefetch.
+type errPrefetchTimeout struct{ error }
+
+func (e errPrefetchTimeout) Unwrap() error { return e.error }
+
+// prefetch makes the ABI, the bytecode and the arguments of a job local.
+func (p *Peer) prefetch(ctx context.Context, job *Job) error {
+	err := p.prefetchInputs(ctx, job)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errPrefetchTimeout{err}
+	}
+	return err
+}
+
+func (p *Peer) prefetchInputs(ctx context.Context, job *Job) error {
+	abi, err := p.GetABI(ctx, job.Fn)
+	if err != nil {
+		return err
+	}
+	cids := []cid.Cid{abi.Bytecode}
+	for _, d := range abi.Deps {
+		cids = append(cids, d.Bytecode)
+	}
+	for _, c := range append(cids, job.Args...) {
+		if _, err := p.fetch(ctx, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Submit queues a call to run in the background and returns the ID of the
+// job.
+func (p *Peer) Submit(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (string, error) {
+	id, err := newJobID()
+	if err != nil {
+		return "", err
+	}
+	job := &Job{
+		ID:    id,
+		Fn:    fnCid,
+		Fx:    fxName,
+		Args:  argsCid,
+		State: JobQueued,
+	}
+	if err := p.putJob(job); err != nil {
+		return "", err
+	}
+	if err := p.jobs.push(job.ID, time.Now()); err != nil {
+		return "", err
+	}
+	return job.ID, nil
+}
+
+// Status returns the current state of a job.
+func (p *Peer) Status(id string) (*Job, error) {
+	b, err := p.store.Get(jobsKey.ChildString(id))
+	if err == datastore.ErrNotFound {
+		return nil, ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := json.Unmarshal(b, job); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Wait blocks until a job finishes and returns it.
+func (p *Peer) Wait(ctx context.Context, id string) (*Job, error) {
+	p.jobs.lk.Lock()
+	done, ok := p.jobs.done[id]
+	p.jobs.lk.Unlock()
+	if ok {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return p.Status(id)
+}
+
+// Cancel stops a job. Canceling a finished job has no effect.
+func (p *Peer) Cancel(id string) error {
+	err := p.updateJob(id, func(job *Job) {
+		if !job.State.Finished() {
+			job.State = JobCanceled
+		}
+	})
+	if err == errJobCanceled {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	p.jobs.lk.Lock()
+	cancel, running := p.jobs.cancel[id]
+	p.jobs.lk.Unlock()
+	if running {
+		cancel()
+	} else {
+		// Don't keep waiters until a retry is due.
+		p.jobs.finish(id)
+	}
+	return nil
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (p *Peer) putJob(job *Job) error {
+	job.Updated = time.Now().Unix()
+	b, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return p.store.Put(jobsKey.ChildString(job.ID), b)
+}
+
+// updateJob applies f to a job, unless it was canceled.
+func (p *Peer) updateJob(id string, f func(*Job)) error {
+	p.jobs.update.Lock()
+	defer p.jobs.update.Unlock()
+	job, err := p.Status(id)
+	if err != nil {
+		return err
+	}
+	if job.State == JobCanceled {
+		return errJobCanceled
+	}
+	f(job)
+	return p.putJob(job)
+}
+
+func (j *Job) String() string {
+	switch j.State {
+	case JobDone:
+		return fmt.Sprintf("Job %s: %s, output %s", j.ID, j.State, j.Output)
+	case JobFailed:
+		if j.Attempts > 1 {
+			return fmt.Sprintf("Job %s: %s after %d attempts, %s", j.ID, j.State, j.Attempts, j.Error)
+		}
+		return fmt.Sprintf("Job %s: %s, %s", j.ID, j.State, j.Error)
+	case JobRetrying:
+		return fmt.Sprintf("Job %s: %s at %s, %s", j.ID, j.State, time.Unix(j.NextAttempt, 0).Format(time.RFC3339), j.Error)
+	}
+	return fmt.Sprintf("Job %s: %s", j.ID, j.State)
+}
@@ -0,0 +1,198 @@
+package ipfslite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-bitswap"
+	"github.com/ipfs/go-bitswap/network"
+	blockservice "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	routinghelpers "github.com/libp2p/go-libp2p-routing-helpers"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+)
+
+func TestJobs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := dagPeer(t)
+	p.ctx = ctx
+
+	// A job queued before a restart.
+	fn, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+	if err := p.putJob(&Job{ID: "restarted", Fn: fn, Fx: "fx", State: JobRunning}); err != nil {
+		t.Fatal(err)
+	}
+
+	p.cfg.Workers = 0
+	p.cfg.MaxAttempts = 2
+	p.cfg.RetryBackoff = 10 * time.Millisecond
+	if err := p.startJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if job, err := p.Status("restarted"); err != nil || job.State != JobQueued {
+		t.Fatalf("unfinished jobs should be queued again, got %v, %v", job, err)
+	}
+
+	canceled, err := p.Submit(ctx, fn, "fx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Cancel(canceled); err != nil {
+		t.Fatal(err)
+	}
+
+	// The function isn't available, so the jobs fail fetching it.
+	go p.jobWorker()
+	job, err := p.Wait(ctx, "restarted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobFailed || job.Error == "" {
+		t.Errorf("job should have failed, got %s", job)
+	}
+	if job.Attempts != 2 || !job.Transient {
+		t.Errorf("fetch failures should be retried, got %d attempts", job.Attempts)
+	}
+	job, err = p.Wait(ctx, canceled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobCanceled {
+		t.Errorf("job should have been canceled, got %s", job)
+	}
+
+	if _, err := p.Status("unknown"); err != ErrJobNotFound {
+		t.Errorf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestJobThunkArgument(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p := runtimePeer(t)
+	p.ctx = ctx
+	p.cfg.EvalThunks = true
+	p.cfg.Workers = 0
+	p.cfg.MaxAttempts = 3
+	p.cfg.RetryBackoff = 10 * time.Millisecond
+	if err := p.startJobs(); err != nil {
+		t.Fatal(err)
+	}
+	go p.jobWorker()
+
+	fn := deployWat(t, p, errorsWat, FxABI{Fxs: []string{"fail", "overflow"}})
+	arg, err := p.NewThunk(ctx, fn, "fail", []cid.Cid{fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Evaluating the argument traps, which would happen again on a retry.
+	id, err := p.Submit(ctx, fn, "overflow", []cid.Cid{*arg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := p.Wait(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobFailed || job.Attempts != 1 || job.Transient {
+		t.Errorf("expected the job to fail once for good, got %s after %d attempts", job, job.Attempts)
+	}
+}
+
+func TestJobFetchTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bitswap asks the other peer for the bytecode, which it doesn't have,
+	// until the prefetch times out.
+	p := dagPeer(t)
+	p.ctx = ctx
+	p.host = mn.Hosts()[0]
+	bswap := bitswap.New(ctx, network.NewFromIpfsHost(p.host, routinghelpers.Null{}), p.bstore)
+	p.bserv = blockservice.New(p.bstore, bswap)
+	p.DAGService = merkledag.NewDAGService(p.bserv)
+	p.cfg.CallTimeout = 200 * time.Millisecond
+	p.cfg.Workers = 0
+	p.cfg.MaxAttempts = 2
+	p.cfg.RetryBackoff = 10 * time.Millisecond
+	if err := p.startJobs(); err != nil {
+		t.Fatal(err)
+	}
+	go p.jobWorker()
+
+	missing, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+	fn, err := p.putABI(ctx, &FxABI{Fxs: []string{"fx"}, Bytecode: missing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := p.Submit(ctx, *fn, "fx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := p.Wait(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobFailed || job.Attempts != 2 || !job.Transient {
+		t.Errorf("expected the job to be retried until it runs out of attempts, got %s after %d attempts", job, job.Attempts)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q := newJobQueue(dagPeer(t).store)
+
+	now := time.Now()
+	for id, at := range map[string]time.Time{
+		"later":  now.Add(50 * time.Millisecond),
+		"first":  now.Add(-time.Second),
+		"second": now,
+	} {
+		if err := q.push(id, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"first", "second", "later"} {
+		if id, ok := q.next(ctx); !ok || id != want {
+			t.Fatalf("expected %s, got %s", want, id)
+		}
+	}
+	if time.Since(now) < 50*time.Millisecond {
+		t.Error("jobs shouldn't run before they're due")
+	}
+	if ids, err := q.queued(); err != nil || len(ids) != 0 {
+		t.Errorf("queue should be empty, got %v, %v", ids, err)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	fetchErr := &FetchError{Err: ipld.ErrNotFound}
+	for err, want := range map[error]bool{
+		fetchErr:                                              true,
+		fmt.Errorf("prefetch: %w", fetchErr):                  true,
+		&FetchError{Err: context.DeadlineExceeded}:            true,
+		&FetchError{Err: context.Canceled}:                    false,
+		errPrefetchTimeout{errors.New("failed to get block")}: true,
+		&FetchError{Err: &TrapError{Code: TrapUnreachable}}:   false,
+		&FetchError{Err: errors.New("invalid UnixFS node")}:   false,
+		&TrapError{Code: TrapUnreachable}:                     false,
+		&PolicyError{Reasons: []string{"big"}}:                false,
+		&LimitError{Limit: LimitCalls}:                        false,
+	} {
+		if transient(err) != want {
+			t.Errorf("transient(%v) should be %v", err, want)
+		}
+	}
+}
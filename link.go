@@ -0,0 +1,84 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/bytecodealliance/wasmtime-go"
+	"github.com/ipfs/go-cid"
+)
+
+// DeployLibrary deploys a module meant to be linked by functions through the
+// Deps of their ABI, so common code is stored and compiled only once.
+// Libraries can import what the policy allows, like the host and WASI
+// functions, but not other libraries.
+func (p *Peer) DeployLibrary(ctx context.Context, bytecode []byte) (*cid.Cid, error) {
+	if err := p.cfg.Policy.Check(bytecode); err != nil {
+		return nil, err
+	}
+	n, err := p.AddFile(ctx, bytes.NewReader(bytecode), &AddParams{})
+	if err != nil {
+		return nil, err
+	}
+	c := n.Cid()
+	return &c, nil
+}
+
+// depModules compiles the libraries of a function.
+func (p *Peer) depModules(ctx context.Context, deps []Dep) ([]*wasmtime.Module, error) {
+	modules := make([]*wasmtime.Module, 0, len(deps))
+	for _, d := range deps {
+		if d.Name == HostModule || d.Name == WasiModule {
+			return nil, fmt.Errorf("library can't be linked as %s", d.Name)
+		}
+		m, err := p.module(ctx, d.Bytecode)
+		if err != nil {
+			return nil, err
+		}
+		modules = append(modules, m)
+	}
+	return modules, nil
+}
+
+// linkDeps instantiates the compiled libraries of a function and defines
+// their exports in the linker. Every call gets its own instances, so
+// libraries don't share memory or globals between calls.
+func (p *Peer) linkDeps(linker *wasmtime.Linker, deps []Dep, modules []*wasmtime.Module) error {
+	for i, d := range deps {
+		instance, err := linker.Instantiate(modules[i])
+		if err != nil {
+			return fmt.Errorf("couldn't instantiate library %s: %s", d.Name, err)
+		}
+		if err := linker.DefineInstance(d.Name, instance); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func depNames(deps []Dep) []string {
+	names := make([]string, 0, len(deps))
+	for _, d := range deps {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
+// parseDeps parses libraries given as <name>=<cid>&<name>=<cid>.
+func parseDeps(s string) ([]Dep, error) {
+	deps := []Dep{}
+	for _, d := range strings.Split(s, "&") {
+		kv := strings.SplitN(d, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid library %q", d)
+		}
+		c, err := cid.Decode(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		deps = append(deps, Dep{Name: kv[0], Bytecode: c})
+	}
+	return deps, nil
+}
@@ -0,0 +1,100 @@
+package ipfslite
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestParseDeps(t *testing.T) {
+	c, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+	deps, err := parseDeps("json=" + c.String() + "&zlib=" + c.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 2 || deps[0].Name != "json" || deps[1].Name != "zlib" || !deps[1].Bytecode.Equals(c) {
+		t.Errorf("unexpected deps %v", deps)
+	}
+
+	for _, s := range []string{"json", "=" + c.String(), "json=foo"} {
+		if _, err := parseDeps(s); err == nil {
+			t.Errorf("expected an error parsing %q", s)
+		}
+	}
+}
+
+const textLibWat = `(module
+	(func (export "upper") (param $c i32) (result i32)
+		(if (result i32) (i32.and
+				(i32.ge_u (local.get $c) (i32.const 0x61))
+				(i32.le_u (local.get $c) (i32.const 0x7a)))
+			(then (i32.sub (local.get $c) (i32.const 0x20)))
+			(else (local.get $c)))))`
+
+// wasiTextLibWat is textLibWat importing a WASI function it doesn't use.
+const wasiTextLibWat = `(module
+	(import "wasi_snapshot_preview1" "proc_exit" (func $exit (param i32)))
+	(func (export "upper") (param $c i32) (result i32)
+		(if (result i32) (i32.and
+				(i32.ge_u (local.get $c) (i32.const 0x61))
+				(i32.le_u (local.get $c) (i32.const 0x7a)))
+			(then (i32.sub (local.get $c) (i32.const 0x20)))
+			(else (local.get $c)))))`
+
+const shoutWat = `(module
+	(import "text" "upper" (func $upper (param i32) (result i32)))
+	(memory (export "memory") 1)
+	(func (export "alloc") (param $size i32) (result i32)
+		(i32.const 1024))
+	(func (export "shout") (param $p i32) (param $n i32) (result i32)
+		(local $i i32)
+		(block $done
+			(loop $next
+				(br_if $done (i32.ge_u (local.get $i) (local.get $n)))
+				(i32.store8 (i32.add (local.get $p) (local.get $i))
+					(call $upper (i32.load8_u (i32.add (local.get $p) (local.get $i)))))
+				(local.set $i (i32.add (local.get $i) (i32.const 1)))
+				(br $next)))
+		(local.get $n)))`
+
+func TestLinkDeps(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	// Libraries get WASI when they import it, even if the function doesn't.
+	for _, src := range []string{textLibWat, wasiTextLibWat} {
+		lib, err := p.DeployLibrary(ctx, wat(t, src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fn := deployWat(t, p, shoutWat, FxABI{Fxs: []string{"shout"}, Deps: []Dep{{Name: "text", Bytecode: *lib}}})
+		abi, err := p.GetABI(ctx, fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex, err := p.execute(ctx, abi, "shout", [][]byte{[]byte("hello, world")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(ex.output) != "HELLO, WORLD" {
+			t.Errorf("unexpected output %q", ex.output)
+		}
+	}
+
+	// Without the library the import is rejected.
+	if _, err := p.DeployABI(ctx, FxABI{Fxs: []string{"shout"}}, wat(t, shoutWat)); err == nil {
+		t.Error("expected the import to be rejected without the library")
+	}
+}
+
+func TestPolicyLinkedImports(t *testing.T) {
+	bytecode := wat(t, shoutWat)
+	pol := DefaultPolicy()
+	if err := pol.Check(bytecode, "text"); err != nil {
+		t.Errorf("expected imports from the library to be allowed: %s", err)
+	}
+	pol.AllowedImports["text"] = []string{"lower"}
+	if err := pol.Check(bytecode, "text"); err == nil {
+		t.Error("expected the policy to restrict the library")
+	}
+}
@@ -0,0 +1,86 @@
+package ipfslite
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Levels of the messages logged with the log host function.
+const (
+	LogDebug = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+// callLog collects what a function logs while it runs, and what it writes
+// to stdout and stderr through WASI, up to max bytes. Anything past max is
+// dropped as it is written.
+type callLog struct {
+	max       int
+	buf       bytes.Buffer
+	truncated bool
+
+	// Lines written to stdout or stderr without a newline yet.
+	partial map[string][]byte
+}
+
+func newCallLog(max int) *callLog {
+	return &callLog{max: max, partial: map[string][]byte{}}
+}
+
+// write appends a line to the log, or as much of it as fits.
+func (l *callLog) write(prefix string, msg []byte) {
+	if l.truncated {
+		return
+	}
+	line := append([]byte("["+prefix+"] "), bytes.TrimRight(msg, "\n")...)
+	line = append(line, '\n')
+	if l.buf.Len()+len(line) > l.max {
+		line = line[:l.max-l.buf.Len()]
+		l.truncated = true
+	}
+	l.buf.Write(line)
+}
+
+// writeStream appends what a function wrote to stdout or stderr, a line at
+// a time. At most max bytes of data are kept, as anything more is truncated.
+func (l *callLog) writeStream(prefix string, data []byte) {
+	if l.truncated {
+		return
+	}
+	if len(data) > l.max {
+		data = data[:l.max]
+	}
+	line := append(l.partial[prefix], data...)
+	for {
+		i := bytes.IndexByte(line, '\n')
+		if i < 0 {
+			break
+		}
+		l.write(prefix, line[:i+1])
+		line = line[i+1:]
+	}
+	if len(line) > l.max {
+		l.write(prefix, line)
+		line = nil
+	}
+	l.partial[prefix] = append([]byte(nil), line...)
+}
+
+// collect returns the log, in the order it was written, finishing the lines
+// left without a newline.
+func (l *callLog) collect() []byte {
+	for _, prefix := range []string{"stdout", "stderr"} {
+		if len(l.partial[prefix]) > 0 {
+			l.write(prefix, l.partial[prefix])
+			delete(l.partial, prefix)
+		}
+	}
+	if l.truncated {
+		return append(l.buf.Bytes(), fmt.Sprintf("[truncated at %d bytes]\n", l.max)...)
+	}
+	return l.buf.Bytes()
+}
@@ -0,0 +1,93 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCallLog(t *testing.T) {
+	l := newCallLog(64)
+	l.write("info", []byte("starting\n"))
+
+	// WASI output is split in lines as it is written.
+	l.writeStream("stdout", []byte("hel"))
+	l.writeStream("stdout", []byte("lo\nwor"))
+	l.writeStream("stderr", []byte("oops\n"))
+	l.writeStream("stdout", []byte("ld"))
+	log := string(l.collect())
+	if log != "[info] starting\n[stdout] hello\n[stderr] oops\n[stdout] world\n" {
+		t.Errorf("unexpected log %q", log)
+	}
+
+	l = newCallLog(64)
+	for i := 0; i < 10; i++ {
+		l.write("debug", []byte("0123456789"))
+	}
+	log = string(l.collect())
+	if !strings.HasSuffix(log, "[truncated at 64 bytes]\n") || len(log) != 64+len("[truncated at 64 bytes]\n") {
+		t.Errorf("log should have been truncated, got %q", log)
+	}
+
+	// Output is bounded while it is written, even without newlines.
+	l = newCallLog(64)
+	for i := 0; i < 1000; i++ {
+		l.writeStream("stdout", bytes.Repeat([]byte("x"), 1000))
+	}
+	if len(l.partial["stdout"]) > 64 || l.buf.Len() > 64 || !l.truncated {
+		t.Errorf("expected the output to be bounded, got %d bytes pending and %d logged", len(l.partial["stdout"]), l.buf.Len())
+	}
+}
+
+// wasiWat writes the argument to stdout the number of times given by its
+// first byte, times 1000.
+const wasiWat = `(module
+	(import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+	(memory (export "memory") 1)
+	(func (export "alloc") (param $size i32) (result i32)
+		(i32.const 1024))
+	(func (export "spam") (param $p i32) (param $n i32) (result i32)
+		(local $i i32)
+		(i32.store (i32.const 0) (local.get $p))
+		(i32.store (i32.const 4) (local.get $n))
+		(local.set $i (i32.mul (i32.load8_u (local.get $p)) (i32.const 1000)))
+		(block $done
+			(loop $next
+				(br_if $done (i32.eqz (local.get $i)))
+				(br_if $done (call $fd_write (i32.const 1) (i32.const 0) (i32.const 1) (i32.const 8)))
+				(local.set $i (i32.sub (local.get $i) (i32.const 1)))
+				(br $next)))
+		(local.get $n)))`
+
+func TestWasiLog(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	p.cfg.MaxLogSize = 1024
+	fn := deployWat(t, p, wasiWat, FxABI{Fxs: []string{"spam"}})
+	abi, err := p.GetABI(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ex, err := p.execute(ctx, abi, "spam", [][]byte{[]byte("\x01 hello\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(ex.log), "[stdout] \x01 hello\n") {
+		t.Errorf("unexpected log %q", ex.log)
+	}
+	if !strings.HasSuffix(string(ex.log), "[truncated at 1024 bytes]\n") || len(ex.log) != 1024+len("[truncated at 1024 bytes]\n") {
+		t.Errorf("expected the log to be truncated, got %d bytes", len(ex.log))
+	}
+
+	// WASI calls are traced like host calls.
+	p.cfg.TraceHostCalls = true
+	ex, err = p.execute(ctx, abi, "spam", [][]byte{[]byte("\x01")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(ex.log), "[stdout] \x01\n[trace] wasi_snapshot_preview1.fd_write(1, 0, 1, 8) -> 0\n") {
+		t.Errorf("expected fd_write to be traced, got %q", ex.log)
+	}
+}
@@ -0,0 +1,84 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+)
+
+// MapReduce runs mapFx over every leaf of a UnixFS file and combines the
+// results with reduceFx following the shape of the DAG. reduceFx is called
+// with two partial results at a time, so it must be associative.
+//
+// Both the result of mapping each leaf and the result of reducing each
+// intermediate node are memoized by CID. When a file is updated, the leaves
+// that didn't change, and all the subtrees made only of them, keep their CIDs,
+// so only the leaves that changed and the nodes on their path to the root are
+// recomputed. The children of a node are reduced as a balanced tree of pairs,
+// so a changed child only reduces again a logarithmic number of pairs.
+//
+// Every map and reduce call is a call of its own, with its own limits, so
+// the size of the file is only bounded by ctx.
+func (p *Peer) MapReduce(ctx context.Context, fnCid cid.Cid, mapFx, reduceFx string, input cid.Cid) (*cid.Cid, error) {
+	return p.mapReduceNode(ctx, fnCid, mapFx, reduceFx, input)
+}
+
+func (p *Peer) mapReduceNode(ctx context.Context, fnCid cid.Cid, mapFx, reduceFx string, c cid.Cid) (*cid.Cid, error) {
+	// The result of a subtree depends on the map and reduce functions.
+	key := callKey(fnCid, mapFx+"+"+reduceFx, []cid.Cid{c})
+	if out, ok, err := p.memoGet(key); err != nil || ok {
+		return out, err
+	}
+
+	n, err := p.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if len(n.Links()) == 0 {
+		return p.CallMemoized(ctx, fnCid, mapFx, []cid.Cid{c})
+	}
+
+	data, err := nodeData(n)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("%s: intermediate nodes with data are not supported", c)
+	}
+
+	results := make([]cid.Cid, 0, len(n.Links()))
+	for _, l := range n.Links() {
+		res, err := p.mapReduceNode(ctx, fnCid, mapFx, reduceFx, l.Cid)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, *res)
+	}
+	out, err := p.reducePairs(ctx, fnCid, reduceFx, results)
+	if err != nil {
+		return nil, err
+	}
+	return out, p.memoPut(key, *out)
+}
+
+// reducePairs reduces the results of the children of a node pairwise, as a
+// balanced tree. Every pair is memoized, so when a child changes only the
+// reductions on its path to the top of the tree run again.
+func (p *Peer) reducePairs(ctx context.Context, fnCid cid.Cid, reduceFx string, results []cid.Cid) (*cid.Cid, error) {
+	for len(results) > 1 {
+		next := make([]cid.Cid, 0, (len(results)+1)/2)
+		for i := 0; i+1 < len(results); i += 2 {
+			out, err := p.CallMemoized(ctx, fnCid, reduceFx, []cid.Cid{results[i], results[i+1]})
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, *out)
+		}
+		if len(results)%2 == 1 {
+			next = append(next, results[len(results)-1])
+		}
+		results = next
+	}
+	return &results[0], nil
+}
@@ -0,0 +1,126 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestMemo(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+	n, err := p.AddFile(ctx, bytes.NewReader([]byte("hello")), &AddParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn, arg, out := n.Cid(), n.Cid(), n.Cid()
+
+	key := callKey(fn, "map", []cid.Cid{arg})
+	if _, ok, err := p.memoGet(key); err != nil || ok {
+		t.Fatalf("unexpected memo hit, %v", err)
+	}
+	if err := p.memoPut(key, out); err != nil {
+		t.Fatal(err)
+	}
+	// The function doesn't exist, so it can only be answered by the memo.
+	c, err := p.CallMemoized(ctx, fn, "map", []cid.Cid{arg})
+	if err != nil || !c.Equals(out) {
+		t.Errorf("expected a memo hit, got %v, %v", c, err)
+	}
+	if _, ok, err := p.memoGet(callKey(fn, "reduce", []cid.Cid{arg})); err != nil || ok {
+		t.Errorf("calls to other fxs shouldn't hit, %v", err)
+	}
+
+	// Subtrees already reduced aren't traversed again.
+	if err := p.memoPut(callKey(fn, "map+reduce", []cid.Cid{arg}), out); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := p.MapReduce(ctx, fn, "map", "reduce", arg); err != nil || !c.Equals(out) {
+		t.Errorf("expected a memo hit, got %v, %v", c, err)
+	}
+}
+
+// lengthWat maps leaves to their length, as 4 bytes, and reduces lengths by
+// adding them up.
+const lengthWat = `(module
+	(memory (export "memory") 1)
+	(global $heap (mut i32) (i32.const 1024))
+	(func (export "alloc") (param $size i32) (result i32)
+		(local $ptr i32)
+		(local.set $ptr (global.get $heap))
+		(global.set $heap (i32.add (global.get $heap) (local.get $size)))
+		(local.get $ptr))
+	(func (export "map") (param $ptr i32) (param $len i32) (result i32)
+		(i32.store (local.get $ptr) (local.get $len))
+		(i32.const 4))
+	(func (export "reduce") (param $ptr i32) (param $a i32) (param $b i32) (result i32)
+		(i32.store (local.get $ptr)
+			(i32.add (i32.load (local.get $ptr)) (i32.load offset=4 (local.get $ptr))))
+		(i32.const 4)))`
+
+func TestMapReduceIncremental(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	// Files with more leaves than calls allowed in a call tree can be mapped.
+	p.cfg.MaxCalls = 2
+	fn := deployWat(t, p, lengthWat, FxABI{Fxs: []string{"map", "reduce"}})
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	calls := func(fx string) int {
+		t.Helper()
+		r, err := p.Receipts(ctx, fn, fx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(r)
+	}
+	run := func(maps, reduces int) {
+		t.Helper()
+		n, err := p.AddFile(ctx, bytes.NewReader(content), &AddParams{Chunker: "size-64"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := p.MapReduce(ctx, fn, "map", "reduce", n.Cid())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := p.GetFile(ctx, *out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != 4 || binary.LittleEndian.Uint32(b) != uint32(len(content)) {
+			t.Errorf("unexpected output %x", b)
+		}
+		if n := calls("map"); n != maps {
+			t.Errorf("expected %d map calls so far, got %d", maps, n)
+		}
+		if n := calls("reduce"); n != reduces {
+			t.Errorf("expected %d reduce calls so far, got %d", reduces, n)
+		}
+	}
+
+	// 16 leaves are reduced pairwise in 4 levels. All but the last leaf have
+	// the same length, so each level only reduces two distinct pairs, and the
+	// last one a single one.
+	run(16, 7)
+	run(16, 7)
+	// Only the leaves that changed are mapped again. Their length doesn't
+	// change so nothing needs to be reduced again.
+	content[0]++
+	content[len(content)-1]++
+	run(18, 7)
+	// Growing the last leaf only changes the pair it is in at each level.
+	content = append(content, 0)
+	run(19, 11)
+}
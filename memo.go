@@ -0,0 +1,56 @@
+package ipfslite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+)
+
+var memoKey = datastore.NewKey("/memo")
+
+// Functions are deterministic, so the output of a call only depends on the
+// function, the fx and the arguments it is called with. The memo table maps
+// call keys to the CID of their output so calls are never run twice.
+
+func memoDsKey(key string) datastore.Key {
+	h := sha256.Sum256([]byte(key))
+	return memoKey.ChildString(hex.EncodeToString(h[:]))
+}
+
+// memoGet returns the memoized output for a call key, if any.
+func (p *Peer) memoGet(key string) (*cid.Cid, bool, error) {
+	b, err := p.store.Get(memoDsKey(key))
+	if err == datastore.ErrNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	c, err := cid.Cast(b)
+	if err != nil {
+		return nil, false, err
+	}
+	return &c, true, nil
+}
+
+// memoPut stores the output of a call.
+func (p *Peer) memoPut(key string, out cid.Cid) error {
+	return p.store.Put(memoDsKey(key), out.Bytes())
+}
+
+// CallMemoized is like Call, but it returns the output of a previous call
+// with the same function, fx and arguments if there was one.
+func (p *Peer) CallMemoized(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*cid.Cid, error) {
+	key := callKey(fnCid, fxName, argsCid)
+	if out, ok, err := p.memoGet(key); err != nil || ok {
+		return out, err
+	}
+	out, err := p.Call(ctx, fnCid, fxName, argsCid)
+	if err != nil {
+		return nil, err
+	}
+	return out, p.memoPut(key, *out)
+}
@@ -0,0 +1,80 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ufsio "github.com/ipfs/go-unixfs/io"
+)
+
+// ComputePrefix is the namespace of paths describing the output of a call.
+const ComputePrefix = "/compute/"
+
+// ComputePath describes the output of a call as
+// /compute/<abiCid>/<fx>/<argCid1>,<argCid2>.
+type ComputePath struct {
+	Fn   cid.Cid
+	Fx   string
+	Args []cid.Cid
+}
+
+// String returns the path representation of the call.
+func (cp ComputePath) String() string {
+	args := make([]string, 0, len(cp.Args))
+	for _, a := range cp.Args {
+		args = append(args, a.String())
+	}
+	return ComputePrefix + cp.Fn.String() + "/" + cp.Fx + "/" + strings.Join(args, ",")
+}
+
+// ParseComputePath parses a /compute/<abiCid>/<fx>/<argCid1>,<argCid2> path.
+func ParseComputePath(path string) (*ComputePath, error) {
+	if !strings.HasPrefix(path, ComputePrefix) {
+		return nil, fmt.Errorf("%s is not a compute path", path)
+	}
+	parts := strings.Split(strings.TrimPrefix(path, ComputePrefix), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+		return nil, fmt.Errorf("compute paths must look like %s<abiCid>/<fx>/<arg1>,<arg2>", ComputePrefix)
+	}
+	fn, err := cid.Decode(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	cp := &ComputePath{Fn: fn, Fx: parts[1], Args: []cid.Cid{}}
+	if len(parts) == 3 && parts[2] != "" {
+		for _, a := range strings.Split(parts[2], ",") {
+			c, err := cid.Decode(a)
+			if err != nil {
+				return nil, err
+			}
+			cp.Args = append(cp.Args, c)
+		}
+	}
+	return cp, nil
+}
+
+// GetPath returns a reader to the file identified by a path. Besides plain
+// CIDs and /ipfs/<cid> paths, it resolves /compute/<abiCid>/<fx>/<args>
+// paths to the output of the call they describe, running it only if its
+// output isn't memoized yet.
+func (p *Peer) GetPath(ctx context.Context, path string) (ufsio.ReadSeekCloser, error) {
+	if strings.HasPrefix(path, ComputePrefix) {
+		cp, err := ParseComputePath(path)
+		if err != nil {
+			return nil, err
+		}
+		out, err := p.CallMemoized(ctx, cp.Fn, cp.Fx, cp.Args)
+		if err != nil {
+			return nil, err
+		}
+		return p.GetFile(ctx, *out)
+	}
+
+	c, err := cid.Decode(strings.TrimPrefix(path, "/ipfs/"))
+	if err != nil {
+		return nil, err
+	}
+	return p.GetFile(ctx, c)
+}
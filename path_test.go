@@ -0,0 +1,41 @@
+package ipfslite
+
+import (
+	"testing"
+)
+
+func TestParseComputePath(t *testing.T) {
+	fn := "bafybeihxh2j47fwociwwl6whvsebfk554p4fua5nssejvftnexgrpsnswi"
+	arg := "bafybeigft6kodyhajn5m2fx6raevfcj6umdob2jiuntufbvttwpygz767q"
+
+	path := ComputePrefix + fn + "/fx/" + arg + "," + arg
+	cp, err := ParseComputePath(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.Fn.String() != fn || cp.Fx != "fx" || len(cp.Args) != 2 {
+		t.Errorf("unexpected compute path: %+v", cp)
+	}
+	if cp.String() != path {
+		t.Errorf("expected %s, got %s", path, cp.String())
+	}
+
+	cp, err = ParseComputePath(ComputePrefix + fn + "/fx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cp.Args) != 0 {
+		t.Error("expected no arguments")
+	}
+
+	for _, bad := range []string{
+		"/ipfs/" + fn,
+		ComputePrefix + fn,
+		ComputePrefix + "notacid/fx/" + arg,
+		ComputePrefix + fn + "/fx/" + arg + ",notacid",
+	} {
+		if _, err := ParseComputePath(bad); err == nil {
+			t.Errorf("%s should not parse", bad)
+		}
+	}
+}
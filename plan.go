@@ -0,0 +1,183 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	ipld "github.com/ipfs/go-ipld-format"
+)
+
+// Plan describes what running a call would involve, without running it.
+//
+// wasmtime-go doesn't meter fuel yet, so the cost of running the function is
+// estimated from the execution time recorded in the receipts of previous
+// calls to the same function.
+type Plan struct {
+	Fn   cid.Cid
+	Fx   string
+	Args []cid.Cid
+
+	Inputs       []InputPlan // Bytecode and arguments.
+	Libraries    []InputPlan // Bytecode of the linked libraries.
+	ModuleCached bool        // Whether the module and its libraries are already compiled.
+	Output       *cid.Cid    // Memoized output of the call, if any.
+
+	Receipts          int           // Number of previous calls found.
+	EstimatedExecTime time.Duration // Zero if there are no receipts.
+}
+
+// InputPlan tells how much of an input DAG is available locally.
+type InputPlan struct {
+	Cid           cid.Cid
+	LocalBlocks   int
+	LocalBytes    uint64
+	MissingBlocks int    // Blocks known to be missing. Missing subtrees count as one.
+	MissingBytes  uint64 // Estimated from the cumulative sizes in the links.
+	RootMissing   bool   // The root itself is missing, so its size is unknown.
+}
+
+// Local is true when the whole input is available locally.
+func (ip InputPlan) Local() bool {
+	return ip.MissingBlocks == 0
+}
+
+// Plan tells which inputs of a call are available locally and which must be
+// fetched, whether its module needs to be compiled, and how long the function
+// is expected to run for. Only the manifest of the function is fetched if it
+// isn't local, as it tells which inputs the call needs; inputs are never
+// fetched, so the size of an input whose root is missing is unknown.
+func (p *Peer) Plan(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*Plan, error) {
+	abi, err := p.GetABI(ctx, fnCid)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Fn: fnCid, Fx: fxName, Args: argsCid}
+	for _, c := range append([]cid.Cid{abi.Bytecode}, argsCid...) {
+		ip, err := p.inputPlan(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		plan.Inputs = append(plan.Inputs, *ip)
+	}
+	plan.ModuleCached = p.modules.has(abi.Bytecode)
+	for _, d := range abi.Deps {
+		ip, err := p.inputPlan(ctx, d.Bytecode)
+		if err != nil {
+			return nil, err
+		}
+		plan.Libraries = append(plan.Libraries, *ip)
+		if !p.modules.has(d.Bytecode) {
+			plan.ModuleCached = false
+		}
+	}
+
+	if out, ok, err := p.memoGet(callKey(fnCid, fxName, argsCid)); err != nil {
+		return nil, err
+	} else if ok {
+		plan.Output = out
+	}
+
+	receipts, err := p.Receipts(ctx, fnCid, fxName)
+	if err != nil {
+		return nil, err
+	}
+	plan.Receipts = len(receipts)
+	if len(receipts) > 0 {
+		var total int64
+		for _, r := range receipts {
+			total += r.ExecTime
+		}
+		plan.EstimatedExecTime = time.Duration(total / int64(len(receipts)))
+	}
+	return plan, nil
+}
+
+// inputPlan walks the part of a DAG available locally.
+func (p *Peer) inputPlan(ctx context.Context, c cid.Cid) (*InputPlan, error) {
+	ip := &InputPlan{Cid: c}
+
+	local, err := p.bstore.Has(c)
+	if err != nil {
+		return nil, err
+	}
+	if !local {
+		ip.MissingBlocks++
+		ip.RootMissing = true
+		return ip, nil
+	}
+	if err := p.walkLocal(ctx, &ipld.Link{Cid: c}, ip); err != nil {
+		return nil, err
+	}
+	return ip, nil
+}
+
+// walkLocal accounts for the blocks under a link, only looking at the local
+// blockstore.
+func (p *Peer) walkLocal(ctx context.Context, l *ipld.Link, ip *InputPlan) error {
+	b, err := p.bstore.Get(l.Cid)
+	if err == blockstore.ErrNotFound {
+		ip.MissingBlocks++
+		ip.MissingBytes += l.Size
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := ipld.Decode(b)
+	if err != nil {
+		return err
+	}
+	ip.LocalBlocks++
+	ip.LocalBytes += uint64(len(b.RawData()))
+	for _, child := range n.Links() {
+		if err := p.walkLocal(ctx, child, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summary tells how much of the input is local and missing.
+func (ip InputPlan) summary() string {
+	if ip.RootMissing {
+		return "missing (size unknown)"
+	}
+	return fmt.Sprintf("%d local blocks (%d bytes), %d missing (%d bytes)",
+		ip.LocalBlocks, ip.LocalBytes, ip.MissingBlocks, ip.MissingBytes)
+}
+
+// String prints the plan in a human readable way.
+func (pl *Plan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Plan for %s in %s\n", pl.Fx, pl.Fn)
+	for i, in := range pl.Inputs {
+		role := "Argument"
+		if i == 0 {
+			role = "Bytecode"
+		}
+		fmt.Fprintf(&b, "  %s %s: %s\n", role, in.Cid, in.summary())
+	}
+	for _, in := range pl.Libraries {
+		fmt.Fprintf(&b, "  Library %s: %s\n", in.Cid, in.summary())
+	}
+	if pl.ModuleCached {
+		fmt.Fprintln(&b, "  Module: compiled")
+	} else {
+		fmt.Fprintln(&b, "  Module: must be compiled")
+	}
+	if pl.Output != nil {
+		fmt.Fprintf(&b, "  Output: memoized at %s\n", pl.Output)
+	}
+	if pl.Receipts > 0 {
+		fmt.Fprintf(&b, "  Estimated execution time: %s (from %d receipts)", pl.EstimatedExecTime, pl.Receipts)
+	} else {
+		fmt.Fprint(&b, "  Estimated execution time: unknown (no receipts)")
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestInputPlan(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+
+	content := make([]byte, 1000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	n, err := p.AddFile(ctx, bytes.NewReader(content), &AddParams{Chunker: "size-64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := p.inputPlan(ctx, n.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.Local() || ip.LocalBlocks != 17 {
+		t.Errorf("expected 17 local blocks, got %+v", ip)
+	}
+
+	// Drop a leaf from the blockstore.
+	leaf := n.Links()[0]
+	if err := p.bstore.DeleteBlock(leaf.Cid); err != nil {
+		t.Fatal(err)
+	}
+	ip, err = p.inputPlan(ctx, n.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.Local() || ip.MissingBlocks != 1 || ip.MissingBytes != leaf.Size || ip.LocalBlocks != 16 {
+		t.Errorf("expected a missing leaf of %d bytes, got %+v", leaf.Size, ip)
+	}
+
+	// Missing roots aren't fetched.
+	ip, err = p.inputPlan(ctx, leaf.Cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ip.RootMissing || ip.MissingBlocks != 1 || ip.LocalBlocks != 0 {
+		t.Errorf("expected a missing root, got %+v", ip)
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+	fn, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+
+	// Calls with the same arguments keep a receipt each.
+	for i := 1; i <= 3; i++ {
+		if _, err := p.putReceipt(ctx, newReceipt(fn, "fx", []cid.Cid{fn}, fn, time.Duration(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receipts, err := p.Receipts(ctx, fn, "fx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(receipts) != 3 {
+		t.Errorf("expected 3 receipts, got %d", len(receipts))
+	}
+}
+
+func TestModuleCache(t *testing.T) {
+	mc := moduleCache{max: 2}
+	a, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+	b, _ := cid.Decode("QmUNLLsPACCz1vLxQVkXqqLX5R1X345qqfHbsf67hvA3Nn")
+	c, _ := cid.Decode("QmQPeNsJPyVWPFDVHb9Yf1pvNeT6ABj9xM3LABLPsRDmmv")
+
+	mc.put(a, nil, nil)
+	mc.put(b, nil, nil)
+	if _, ok := mc.get(a); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	// b is now the least recently used.
+	mc.put(c, nil, nil)
+	if !mc.has(a) || mc.has(b) || !mc.has(c) {
+		t.Errorf("expected b to be evicted")
+	}
+	if mc.recent.Len() != 2 || len(mc.modules) != 2 {
+		t.Errorf("expected 2 modules, got %d", mc.recent.Len())
+	}
+}
@@ -0,0 +1,187 @@
+package ipfslite
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// Policy restricts the modules a peer accepts to deploy and run. Modules are
+// checked before being compiled or instantiated.
+type Policy struct {
+	// AllowedImports maps the namespaces modules may import from to the
+	// functions they may import. "*" allows any function in the namespace.
+	// Namespaces of linked libraries are allowed unless they are listed,
+	// in which case only the listed functions can be imported from them.
+	AllowedImports map[string][]string
+	// MaxMemoryPages limits the memory of modules, in 64KiB pages. Modules
+	// declaring a larger initial or maximum memory are rejected, and calls
+	// whose memory grows past it fail with a *LimitError. Zero means no
+	// limit.
+	MaxMemoryPages uint32
+	// MaxModuleSize limits the size of the bytecode. Zero means no limit.
+	MaxModuleSize int
+	// AllowThreads allows modules using shared memories and atomics.
+	AllowThreads bool
+	// AllowSIMD allows modules using SIMD instructions.
+	AllowSIMD bool
+}
+
+// memoryLimit returns a *LimitError if a memory grew past maxPages. Most
+// toolchains don't declare a maximum memory, so guests can grow it at run
+// time and the limit is checked after every call into the guest and whenever
+// it calls the host.
+func memoryLimit(mem *wasmtime.Memory, maxPages uint32) error {
+	if maxPages > 0 && mem.Size() > maxPages {
+		return &LimitError{Limit: LimitMemory, Max: fmt.Sprintf("%d pages", maxPages)}
+	}
+	return nil
+}
+
+// wasmFeatures are the optional WASM features a policy can allow.
+type wasmFeatures struct {
+	threads, simd bool
+}
+
+// validators keeps a store to validate modules with for each set of features,
+// as the features of an engine can't change once it is created.
+var validators = struct {
+	sync.Mutex
+	stores map[wasmFeatures]*wasmtime.Store
+}{stores: map[wasmFeatures]*wasmtime.Store{}}
+
+// validator returns the store validating modules using the given features.
+func validator(f wasmFeatures) *wasmtime.Store {
+	validators.Lock()
+	defer validators.Unlock()
+	if s, ok := validators.stores[f]; ok {
+		return s
+	}
+	cfg := wasmtime.NewConfig()
+	cfg.SetWasmThreads(f.threads)
+	cfg.SetWasmSIMD(f.simd)
+	s := wasmtime.NewStore(wasmtime.NewEngineWithConfig(cfg))
+	validators.stores[f] = s
+	return s
+}
+
+// DefaultPolicy only allows importing the functions provided by the host and
+// the WASI functions needed to write to stdout and stderr, and limits modules
+// to 16MiB of bytecode and 256MiB of memory.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		AllowedImports: map[string][]string{
+			HostModule: {"*"},
+			WasiModule: {"fd_write", "fd_close", "fd_seek", "fd_fdstat_get", "proc_exit",
+				"args_get", "args_sizes_get", "environ_get", "environ_sizes_get"},
+		},
+		MaxMemoryPages: 4096,
+		MaxModuleSize:  16 << 20,
+	}
+}
+
+// PolicyError is returned when a module doesn't comply with the policy of
+// the peer.
+type PolicyError struct {
+	Reasons []string
+}
+
+func (e *PolicyError) Error() string {
+	return "module rejected by policy: " + strings.Join(e.Reasons, "; ")
+}
+
+// allowsImport tells if a function can be imported from a namespace.
+func (pol *Policy) allowsImport(module, name string) bool {
+	for _, n := range pol.AllowedImports[module] {
+		if n == "*" || n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsLinked tells if anything can be imported from a namespace because it
+// is provided by a library and the policy doesn't restrict it.
+func (pol *Policy) allowsLinked(module string, linked []string) bool {
+	_, listed := pol.AllowedImports[module]
+	return !listed && contains(linked, module)
+}
+
+// checkMemory adds the reasons why a memory is rejected.
+func (pol *Policy) checkMemory(l *wasmLimits, reasons []string) []string {
+	if l.shared && !pol.AllowThreads {
+		reasons = append(reasons, "shared memories are not allowed")
+	}
+	if pol.MaxMemoryPages == 0 {
+		return reasons
+	}
+	if l.min > pol.MaxMemoryPages {
+		reasons = append(reasons, fmt.Sprintf("initial memory of %d pages exceeds the maximum of %d", l.min, pol.MaxMemoryPages))
+	}
+	if l.max != nil && *l.max > pol.MaxMemoryPages {
+		reasons = append(reasons, fmt.Sprintf("maximum memory of %d pages exceeds the maximum of %d", *l.max, pol.MaxMemoryPages))
+	}
+	return reasons
+}
+
+// Check returns a *PolicyError with every reason why the bytecode is
+// rejected, or nil if it complies with the policy. linked are the namespaces
+// provided by libraries, see AllowedImports.
+func (pol *Policy) Check(bytecode []byte, linked ...string) error {
+	reasons := []string{}
+	if pol.MaxModuleSize > 0 && len(bytecode) > pol.MaxModuleSize {
+		reasons = append(reasons, fmt.Sprintf("module size of %d bytes exceeds the maximum of %d", len(bytecode), pol.MaxModuleSize))
+	}
+
+	sections, err := wasmSections(bytecode)
+	if err != nil {
+		return &PolicyError{Reasons: append(reasons, err.Error())}
+	}
+	for _, s := range sections {
+		switch s.id {
+		case wasmImportSection:
+			imports, err := wasmImports(s)
+			if err != nil {
+				return &PolicyError{Reasons: append(reasons, err.Error())}
+			}
+			for _, imp := range imports {
+				if imp.kind == wasmMemoryKind {
+					reasons = pol.checkMemory(imp.memory, reasons)
+				}
+				if !pol.allowsImport(imp.module, imp.name) && !pol.allowsLinked(imp.module, linked) {
+					reasons = append(reasons, fmt.Sprintf("import %s.%s is not allowed", imp.module, imp.name))
+				}
+			}
+		case wasmMemorySection:
+			mems, err := wasmMemories(s)
+			if err != nil {
+				return &PolicyError{Reasons: append(reasons, err.Error())}
+			}
+			for _, l := range mems {
+				reasons = pol.checkMemory(l, reasons)
+			}
+		}
+	}
+
+	// Let wasmtime find the instructions from disabled features.
+	features := wasmFeatures{threads: pol.AllowThreads, simd: pol.AllowSIMD}
+	if err := wasmtime.ModuleValidate(validator(features), bytecode); err != nil {
+		reasons = append(reasons, fmt.Sprintf("invalid module or disallowed features: %s", err))
+	}
+
+	if len(reasons) > 0 {
+		return &PolicyError{Reasons: reasons}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package ipfslite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+func wat(t *testing.T, src string) []byte {
+	t.Helper()
+	b, err := wasmtime.Wat2Wasm(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPolicyLimits(t *testing.T) {
+	pol := DefaultPolicy()
+	if !pol.allowsImport(HostModule, "call") {
+		t.Error("host functions should be allowed")
+	}
+	if pol.allowsImport("env", "abort") {
+		t.Error("env.abort should not be allowed")
+	}
+
+	max := uint32(8192)
+	if r := pol.checkMemory(&wasmLimits{min: 1}, nil); len(r) != 0 {
+		t.Errorf("unexpected reasons %v", r)
+	}
+	if r := pol.checkMemory(&wasmLimits{min: 1, max: &max, shared: true}, nil); len(r) != 2 {
+		t.Errorf("expected 2 reasons, got %v", r)
+	}
+
+	if _, err := wasmSections([]byte("not wasm")); err == nil {
+		t.Error("expected an error for invalid bytecode")
+	}
+}
+
+func TestWasmMemoryImport(t *testing.T) {
+	sections, err := wasmSections(wat(t, `(module (import "env" "memory" (memory 2 4)))`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range sections {
+		if s.id != wasmImportSection {
+			continue
+		}
+		imports, err := wasmImports(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(imports) != 1 || imports[0].kind != wasmMemoryKind {
+			t.Fatalf("unexpected imports %v", imports)
+		}
+		l := imports[0].memory
+		if l.min != 2 || l.max == nil || *l.max != 4 {
+			t.Errorf("unexpected limits %+v", l)
+		}
+		return
+	}
+	t.Fatal("no import section")
+}
+
+const simdWat = `(module
+	(func (export "zero") (result i32)
+		(i32x4.extract_lane 0 (v128.const i32x4 0 0 0 0))))`
+
+func TestPolicyFeatures(t *testing.T) {
+	bytecode := wat(t, simdWat)
+	pol := DefaultPolicy()
+	if err := pol.Check(bytecode); err == nil {
+		t.Error("expected SIMD to be rejected")
+	}
+	pol.AllowSIMD = true
+	if err := pol.Check(bytecode); err != nil {
+		t.Errorf("expected SIMD to be allowed: %s", err)
+	}
+	pol.AllowSIMD = false
+	if err := pol.Check(bytecode); err == nil {
+		t.Error("expected SIMD to be rejected again")
+	}
+
+	// Modules the policy allows can be compiled.
+	ctx := context.Background()
+	p := runtimePeer(t)
+	p.cfg.Policy.AllowSIMD = true
+	fn := deployWat(t, p, simdWat, FxABI{Fxs: []string{"zero"}})
+	abi, err := p.GetABI(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.module(ctx, abi.Bytecode); err != nil {
+		t.Errorf("expected the SIMD module to compile: %s", err)
+	}
+}
+
+// growWat has functions growing their memory by 8 pages, and growlog then
+// calls the host.
+const growWat = `(module
+	(import "ipfs" "log" (func $log (param i32 i32 i32)))
+	(memory (export "memory") 1)
+	(global $heap (mut i32) (i32.const 1024))
+	(func (export "alloc") (param $size i32) (result i32)
+		(local $ptr i32)
+		(local.set $ptr (global.get $heap))
+		(global.set $heap (i32.add (global.get $heap) (local.get $size)))
+		(local.get $ptr))
+	(func (export "grow") (param $ptr i32) (param $len i32) (result i32)
+		(drop (memory.grow (i32.const 8)))
+		(i32.const 0))
+	(func (export "growlog") (param $ptr i32) (param $len i32) (result i32)
+		(drop (memory.grow (i32.const 8)))
+		(call $log (i32.const 1) (local.get $ptr) (local.get $len))
+		unreachable))`
+
+func TestMemoryLimit(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	// The module doesn't declare a maximum memory, so only its initial one
+	// is checked before it runs.
+	fn := deployWat(t, p, growWat, FxABI{Fxs: []string{"grow", "growlog"}})
+	abi, err := p.GetABI(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.cfg.Policy.MaxMemoryPages = 4
+	for _, fx := range []string{"grow", "growlog"} {
+		var limit *LimitError
+		_, err := p.execute(ctx, abi, fx, [][]byte{[]byte("input")})
+		if !errors.As(err, &limit) || limit.Limit != LimitMemory {
+			t.Errorf("%s: expected the memory limit to be exceeded, got %v", fx, err)
+		}
+	}
+
+	p.cfg.Policy.MaxMemoryPages = 16
+	if _, err := p.execute(ctx, abi, "grow", [][]byte{[]byte("input")}); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPolicyCachedModule(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	fn := deployWat(t, p, `(module (func (export "fx")))`, FxABI{Fxs: []string{"fx"}})
+	abi, err := p.GetABI(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.module(ctx, abi.Bytecode); err != nil {
+		t.Fatal(err)
+	}
+	if !p.modules.has(abi.Bytecode) {
+		t.Fatal("expected the module to be cached")
+	}
+
+	// Modules are checked again once cached.
+	p.cfg.Policy.MaxModuleSize = 1
+	var polErr *PolicyError
+	if _, err := p.module(ctx, abi.Bytecode); !errors.As(err, &polErr) {
+		t.Errorf("expected a policy error, got %v", err)
+	}
+}
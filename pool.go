@@ -0,0 +1,262 @@
+package ipfslite
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Pools of workers run calls for other peers. Peers submitting a call
+// announce it on the topic of the pool, and workers with free slots claim it.
+// The submitter leases the job to the first worker claiming it, which renews
+// the lease while running the job and publishes its result. Jobs whose lease
+// expires are announced again, so they are run by another worker if the first
+// one goes away.
+//
+// The submitter is the only one granting leases, so a job isn't run twice
+// unless its worker stops renewing the lease while still running it.
+
+// ErrNoPubSub is returned when using pools without Config.PubSub.
+var ErrNoPubSub = errors.New("no pubsub router configured")
+
+const poolTopicPrefix = "/ipfs-lite/pool/"
+
+// Types of pool messages.
+const (
+	poolJob    = "job"
+	poolClaim  = "claim"
+	poolLease  = "lease"
+	poolRenew  = "renew"
+	poolResult = "result"
+)
+
+// poolMsg is a message of the lease protocol.
+type poolMsg struct {
+	Type   string
+	Job    *Job    // Just the ID for claims and renewals.
+	Worker peer.ID `json:",omitempty"` // The worker a job is leased to.
+
+	from peer.ID
+}
+
+// PoolTopic returns the pubsub topic of a pool. Pools can be named after a
+// function to have workers dedicated to it.
+func PoolTopic(pool string) string {
+	return poolTopicPrefix + pool
+}
+
+func (p *Peer) publishPool(ctx context.Context, pool string, m *poolMsg) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return p.cfg.PubSub.Publish(ctx, PoolTopic(pool), b)
+}
+
+// subscribePool returns the messages published in a pool until ctx is done.
+func (p *Peer) subscribePool(ctx context.Context, pool string) (<-chan *poolMsg, error) {
+	if p.cfg.PubSub == nil {
+		return nil, ErrNoPubSub
+	}
+	if p.host == nil {
+		return nil, errors.New("pools need a libp2p host")
+	}
+	sub, err := p.cfg.PubSub.Subscribe(PoolTopic(pool))
+	if err != nil {
+		return nil, err
+	}
+	msgs := make(chan *poolMsg)
+	go func() {
+		defer sub.Cancel()
+		defer close(msgs)
+		for {
+			m, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			pm := &poolMsg{from: m.From}
+			if err := json.Unmarshal(m.Data, pm); err != nil || pm.Job == nil {
+				logger.Debugf("invalid pool message from %s", m.From)
+				continue
+			}
+			select {
+			case msgs <- pm:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return msgs, nil
+}
+
+// CallPool runs a call on one of the workers of a pool and returns the
+// finished job. The output and the receipt of the call can then be fetched
+// from the worker.
+func (p *Peer) CallPool(ctx context.Context, pool string, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*Job, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgs, err := p.subscribePool(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newJobID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{ID: id, Fn: fnCid, Fx: fxName, Args: argsCid, State: JobQueued}
+	if err := p.publishPool(ctx, pool, &poolMsg{Type: poolJob, Job: job}); err != nil {
+		return nil, err
+	}
+
+	var worker peer.ID
+	var expires time.Time
+	ticker := time.NewTicker(p.cfg.LeaseTime / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				return nil, ctx.Err()
+			}
+			if m.Job.ID != id {
+				continue
+			}
+			switch m.Type {
+			case poolClaim:
+				if worker != "" && time.Now().Before(expires) {
+					continue
+				}
+				worker = m.from
+				expires = time.Now().Add(p.cfg.LeaseTime)
+				if err := p.publishPool(ctx, pool, &poolMsg{Type: poolLease, Job: job, Worker: worker}); err != nil {
+					return nil, err
+				}
+			case poolRenew:
+				if m.from == worker {
+					expires = time.Now().Add(p.cfg.LeaseTime)
+				}
+			case poolResult:
+				if m.from != worker {
+					continue
+				}
+				res := *job
+				res.State = m.Job.State
+				res.Output = m.Job.Output
+				res.Receipt = m.Job.Receipt
+				res.Error = m.Job.Error
+				res.Transient = m.Job.Transient
+				res.Worker = worker
+				res.Updated = time.Now().Unix()
+				return &res, nil
+			}
+		case <-ticker.C:
+			if worker != "" && time.Now().After(expires) {
+				logger.Warningf("lease of job %s to %s expired", id, worker)
+				worker = ""
+			}
+			if worker == "" {
+				// Announce it again in case nobody was listening.
+				if err := p.publishPool(ctx, pool, &poolMsg{Type: poolJob, Job: job}); err != nil {
+					return nil, err
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Work makes the peer a worker of a pool until ctx is done. It claims the
+// jobs announced in the pool while it has free workers, runs the ones leased
+// to it like submitted jobs, and publishes their results.
+func (p *Peer) Work(ctx context.Context, pool string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msgs, err := p.subscribePool(ctx, pool)
+	if err != nil {
+		return err
+	}
+
+	var lk sync.Mutex
+	running := map[string]bool{}
+	for m := range msgs {
+		lk.Lock()
+		free := len(running) < p.cfg.Workers
+		busy := running[m.Job.ID]
+		lk.Unlock()
+
+		switch m.Type {
+		case poolJob:
+			if !free || busy {
+				continue
+			}
+			claim := &poolMsg{Type: poolClaim, Job: &Job{ID: m.Job.ID}}
+			if err := p.publishPool(ctx, pool, claim); err != nil {
+				logger.Error(err)
+			}
+		case poolLease:
+			if m.Worker != p.host.ID() || busy {
+				continue
+			}
+			lk.Lock()
+			running[m.Job.ID] = true
+			lk.Unlock()
+			go func(job *Job) {
+				if err := p.runLeased(ctx, pool, job); err != nil {
+					logger.Errorf("job %s of pool %s: %s", job.ID, pool, err)
+				}
+				lk.Lock()
+				delete(running, job.ID)
+				lk.Unlock()
+			}(m.Job)
+		}
+	}
+	return ctx.Err()
+}
+
+// runLeased runs a job leased to the peer, renewing the lease until it's
+// done.
+func (p *Peer) runLeased(ctx context.Context, pool string, job *Job) error {
+	id, err := p.Submit(ctx, job.Fn, job.Fx, job.Args)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(p.cfg.LeaseTime / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				renew := &poolMsg{Type: poolRenew, Job: &Job{ID: job.ID}}
+				if err := p.publishPool(ctx, pool, renew); err != nil {
+					logger.Error(err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	res, err := p.Wait(ctx, id)
+	if err != nil {
+		p.Cancel(id)
+		return err
+	}
+	result := &Job{
+		ID:        job.ID,
+		State:     res.State,
+		Output:    res.Output,
+		Receipt:   res.Receipt,
+		Error:     res.Error,
+		Transient: res.Transient,
+	}
+	return p.publishPool(ctx, pool, &poolMsg{Type: poolResult, Job: result})
+}
@@ -0,0 +1,238 @@
+package ipfslite
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// memHub is an in-process pubsub router shared by the peers of a test.
+type memHub struct {
+	lk   sync.Mutex
+	subs map[string]map[*memSub]bool
+}
+
+type memPubSub struct {
+	hub *memHub
+	id  peer.ID
+}
+
+type memSub struct {
+	hub    *memHub
+	topic  string
+	ch     chan *PubSubMessage
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (ps *memPubSub) Publish(ctx context.Context, topic string, data []byte) error {
+	ps.hub.lk.Lock()
+	subs := make([]*memSub, 0, len(ps.hub.subs[topic]))
+	for s := range ps.hub.subs[topic] {
+		subs = append(subs, s)
+	}
+	ps.hub.lk.Unlock()
+
+	for _, s := range subs {
+		select {
+		case s.ch <- &PubSubMessage{From: ps.id, Data: data}:
+		case <-s.closed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+func (ps *memPubSub) Subscribe(topic string) (Subscription, error) {
+	s := &memSub{hub: ps.hub, topic: topic, ch: make(chan *PubSubMessage, 256), closed: make(chan struct{})}
+	ps.hub.lk.Lock()
+	if ps.hub.subs[topic] == nil {
+		ps.hub.subs[topic] = map[*memSub]bool{}
+	}
+	ps.hub.subs[topic][s] = true
+	ps.hub.lk.Unlock()
+	return s, nil
+}
+
+func (s *memSub) Next(ctx context.Context) (*PubSubMessage, error) {
+	select {
+	case m := <-s.ch:
+		return m, nil
+	case <-s.closed:
+		return nil, errors.New("subscription canceled")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *memSub) Cancel() {
+	s.once.Do(func() {
+		s.hub.lk.Lock()
+		delete(s.hub.subs[s.topic], s)
+		s.hub.lk.Unlock()
+		close(s.closed)
+	})
+}
+
+// poolPeers returns peers sharing an in-process pubsub router, with their job
+// workers started.
+func poolPeers(t *testing.T, ctx context.Context, n int) ([]*Peer, *memHub) {
+	hub := &memHub{subs: map[string]map[*memSub]bool{}}
+	peers := newPoolPeers(t, ctx, n, func(h host.Host) PubSub {
+		return &memPubSub{hub: hub, id: h.ID()}
+	})
+	return peers, hub
+}
+
+// newPoolPeers returns peers connected over a mock network, using the
+// pubsub routers returned by newPubSub, with their job workers started.
+func newPoolPeers(t *testing.T, ctx context.Context, n int, newPubSub func(host.Host) PubSub) []*Peer {
+	mn := mocknet.New(ctx)
+	for i := 0; i < n; i++ {
+		// Real keys, as gossipsub signs messages with them.
+		sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := multiaddr.NewMultiaddr(fmt.Sprintf("/ip4/100.64.0.%d/tcp/4242", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := mn.AddPeer(sk, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+
+	peers := make([]*Peer, n)
+	for i, h := range mn.Hosts() {
+		p := dagPeer(t)
+		p.ctx = ctx
+		p.host = h
+		p.cfg.PubSub = newPubSub(h)
+		p.cfg.Workers = 1
+		p.cfg.MaxAttempts = 1
+		p.cfg.LeaseTime = 300 * time.Millisecond
+		if err := p.startJobs(); err != nil {
+			t.Fatal(err)
+		}
+		peers[i] = p
+	}
+	if err := mn.ConnectAllButSelf(); err != nil {
+		t.Fatal(err)
+	}
+	return peers
+}
+
+func countJobs(t *testing.T, p *Peer) int {
+	res, err := p.store.Query(query.Query{Prefix: jobsKey.String(), KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestCallPool(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	peers, _ := poolPeers(t, ctx, 3)
+	testCallPool(t, ctx, peers, 50*time.Millisecond)
+}
+
+// testCallPool runs a job from the first peer on a pool made of the others,
+// once their subscriptions had time to settle.
+func testCallPool(t *testing.T, ctx context.Context, peers []*Peer, settle time.Duration) {
+	client, workers := peers[0], peers[1:]
+	for _, w := range workers {
+		go w.Work(ctx, "test")
+	}
+	// Let the workers subscribe.
+	time.Sleep(settle)
+
+	// The function isn't available anywhere, so the job fails fetching it.
+	fn, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+	job, err := client.CallPool(ctx, "test", fn, "fx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.State != JobFailed || job.Error == "" || !job.Transient {
+		t.Errorf("job should have failed fetching, got %s", job)
+	}
+	if job.Worker != workers[0].host.ID() && job.Worker != workers[1].host.ID() {
+		t.Errorf("job should have run on a worker, got %s", job.Worker)
+	}
+	if n := countJobs(t, workers[0]) + countJobs(t, workers[1]); n != 1 {
+		t.Errorf("job should have run once, ran %d times", n)
+	}
+}
+
+func TestCallPoolLeaseExpired(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	peers, hub := poolPeers(t, ctx, 3)
+	client, worker := peers[0], peers[1]
+
+	// A worker that claims the job and goes away once it is leased.
+	gone := &memPubSub{hub: hub, id: peers[2].host.ID()}
+	sub, _ := gone.Subscribe(PoolTopic("test"))
+	leased := make(chan struct{})
+	go func() {
+		defer sub.Cancel()
+		for {
+			m, err := sub.Next(ctx)
+			if err != nil {
+				return
+			}
+			pm := &poolMsg{}
+			json.Unmarshal(m.Data, pm)
+			switch {
+			case pm.Type == poolJob:
+				claim, _ := json.Marshal(&poolMsg{Type: poolClaim, Job: &Job{ID: pm.Job.ID}})
+				gone.Publish(ctx, PoolTopic("test"), claim)
+			case pm.Type == poolLease && pm.Worker == gone.id:
+				close(leased)
+				return
+			}
+		}
+	}()
+	go func() {
+		<-leased
+		worker.Work(ctx, "test")
+	}()
+
+	fn, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+	job, err := client.CallPool(ctx, "test", fn, "fx", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Worker != worker.host.ID() {
+		t.Errorf("job should have been leased again, ran on %s", job.Worker)
+	}
+}
+
+func TestCallPoolNoPubSub(t *testing.T) {
+	p := dagPeer(t)
+	if _, err := p.CallPool(context.Background(), "test", cid.Undef, "fx", nil); err != ErrNoPubSub {
+		t.Errorf("expected ErrNoPubSub, got %v", err)
+	}
+}
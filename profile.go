@@ -0,0 +1,116 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	bitswap "github.com/ipfs/go-bitswap"
+	"github.com/ipfs/go-cid"
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+type profileKey struct{}
+
+// Profile breaks down where the time of a call went.
+//
+// wasmtime-go doesn't meter fuel yet, so the work done by the function is
+// only measured by its execution time.
+type Profile struct {
+	Fetches         []FetchProfile
+	Compile         time.Duration // Zero if the modules were already compiled.
+	Instantiate     time.Duration // Including compile time.
+	Exec            time.Duration
+	PeakMemoryPages uint32 // Memory only grows, so this is its size once the call is done.
+	OutputImport    time.Duration
+}
+
+// FetchProfile tells how long fetching an input took.
+type FetchProfile struct {
+	Cid   cid.Cid
+	Time  time.Duration
+	Bytes int
+	// Peers blocks were received from while fetching. Bitswap doesn't tell
+	// which call the blocks were for, so concurrent calls may show up here.
+	Peers []peer.ID
+}
+
+func withProfile(ctx context.Context, pr *Profile) context.Context {
+	return context.WithValue(ctx, profileKey{}, pr)
+}
+
+// profileOf returns the profile of the call running in the context, which is
+// nil if the call isn't profiled. Profiles can be updated through nil.
+func profileOf(ctx context.Context) *Profile {
+	pr, _ := ctx.Value(profileKey{}).(*Profile)
+	return pr
+}
+
+func (pr *Profile) addCompile(d time.Duration) {
+	if pr != nil {
+		pr.Compile += d
+	}
+}
+
+// fetchProfiled fetches an input recording how long it took and where its
+// blocks came from.
+func (p *Peer) fetchProfiled(ctx context.Context, c cid.Cid) ([]byte, error) {
+	pr := profileOf(ctx)
+	if pr == nil {
+		return p.fetch(ctx, c)
+	}
+
+	before := p.bitswapReceived()
+	start := time.Now()
+	d, err := p.fetch(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	fp := FetchProfile{Cid: c, Time: time.Since(start), Bytes: len(d)}
+	for id, recv := range p.bitswapReceived() {
+		if recv > before[id] {
+			fp.Peers = append(fp.Peers, id)
+		}
+	}
+	pr.Fetches = append(pr.Fetches, fp)
+	return d, nil
+}
+
+// bitswapReceived returns the bytes received from each connected peer.
+func (p *Peer) bitswapReceived() map[peer.ID]uint64 {
+	recv := map[peer.ID]uint64{}
+	bs, ok := p.bserv.Exchange().(*bitswap.Bitswap)
+	if !ok || p.host == nil {
+		return recv
+	}
+	for _, id := range p.host.Network().Peers() {
+		if l := bs.LedgerForPeer(id); l != nil {
+			recv[id] = l.Recv
+		}
+	}
+	return recv
+}
+
+// String prints the profile in a human readable way.
+func (pr *Profile) String() string {
+	var b strings.Builder
+	fmt.Fprintln(&b, "Profile:")
+	for _, f := range pr.Fetches {
+		from := "local"
+		if len(f.Peers) > 0 {
+			peers := make([]string, 0, len(f.Peers))
+			for _, id := range f.Peers {
+				peers = append(peers, id.Pretty())
+			}
+			from = strings.Join(peers, ", ")
+		}
+		fmt.Fprintf(&b, "  Fetch %s: %s (%d bytes from %s)\n", f.Cid, f.Time, f.Bytes, from)
+	}
+	fmt.Fprintf(&b, "  Compile: %s\n", pr.Compile)
+	fmt.Fprintf(&b, "  Instantiate: %s\n", pr.Instantiate)
+	fmt.Fprintf(&b, "  Exec: %s\n", pr.Exec)
+	fmt.Fprintf(&b, "  Peak memory: %d pages (%d bytes)\n", pr.PeakMemoryPages, uint64(pr.PeakMemoryPages)*wasmPageSize)
+	fmt.Fprintf(&b, "  Output import: %s", pr.OutputImport)
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFetchProfiled(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+
+	n, err := p.AddFile(ctx, bytes.NewReader([]byte("some input")), &AddParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fetches are only recorded for profiled calls.
+	if _, err := p.fetchProfiled(ctx, n.Cid()); err != nil {
+		t.Fatal(err)
+	}
+
+	pr := &Profile{}
+	ctx = withProfile(ctx, pr)
+	if _, err := p.fetchProfiled(ctx, n.Cid()); err != nil {
+		t.Fatal(err)
+	}
+	profileOf(ctx).addCompile(time.Millisecond)
+
+	if len(pr.Fetches) != 1 {
+		t.Fatalf("expected 1 fetch, got %d", len(pr.Fetches))
+	}
+	f := pr.Fetches[0]
+	if !f.Cid.Equals(n.Cid()) || f.Bytes != len("some input") || len(f.Peers) != 0 {
+		t.Errorf("unexpected fetch profile %+v", f)
+	}
+	if pr.Compile != time.Millisecond {
+		t.Errorf("unexpected compile time %s", pr.Compile)
+	}
+}
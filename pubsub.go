@@ -0,0 +1,28 @@
+package ipfslite
+
+import (
+	"context"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+)
+
+// PubSub is the pubsub router workers use to exchange jobs. Messages must
+// come with the peer that published them, authenticated like the signed
+// messages of gossipsub. NewGossipSub adapts go-libp2p-pubsub to it.
+type PubSub interface {
+	Publish(ctx context.Context, topic string, data []byte) error
+	Subscribe(topic string) (Subscription, error)
+}
+
+// Subscription delivers the messages published on a topic, including the
+// ones published by the peer itself.
+type Subscription interface {
+	Next(ctx context.Context) (*PubSubMessage, error)
+	Cancel()
+}
+
+// PubSubMessage is a message received from a topic.
+type PubSubMessage struct {
+	From peer.ID
+	Data []byte
+}
@@ -0,0 +1,114 @@
+package ipfslite
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+var receiptsKey = datastore.NewKey("/receipts")
+
+func init() {
+	cbornode.RegisterCborType(Receipt{})
+}
+
+// Receipt records a call run by the peer. Receipts are stored as dag-cbor
+// nodes, and indexed in the datastore by function and fx so they can be used
+// to estimate the cost of future calls.
+type Receipt struct {
+	Fn       cid.Cid
+	Fx       string
+	Args     []cid.Cid
+	Output   cid.Cid
+	ExecTime int64    // Time the function ran for, in nanoseconds.
+	Time     int64    // When the call finished, as a unix timestamp.
+	Log      *cid.Cid `refmt:",omitempty"` // What the function logged, if anything.
+}
+
+// receiptDsKey indexes receipts under /receipts/<fn>/<fx>/<receipt>, so every
+// call keeps its receipt even when the same arguments were used before.
+func receiptDsKey(fnCid cid.Cid, fxName string, c cid.Cid) datastore.Key {
+	return receiptsKey.ChildString(fnCid.String()).ChildString(fxName).ChildString(c.String())
+}
+
+// receiptCid returns the CID a receipt is stored under.
+func receiptCid(r *Receipt) (cid.Cid, error) {
+	n, err := cbornode.WrapObject(r, multihash.SHA2_256, -1)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return n.Cid(), nil
+}
+
+// putReceipt adds a receipt to the DAG and indexes it.
+func (p *Peer) putReceipt(ctx context.Context, r *Receipt) (*cid.Cid, error) {
+	n, err := cbornode.WrapObject(r, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Add(ctx, n); err != nil {
+		return nil, err
+	}
+	c := n.Cid()
+	if err := p.store.Put(receiptDsKey(r.Fn, r.Fx, c), c.Bytes()); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// GetReceipt fetches and decodes a receipt.
+func (p *Peer) GetReceipt(ctx context.Context, c cid.Cid) (*Receipt, error) {
+	n, err := p.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	r := Receipt{}
+	if err := cbornode.DecodeInto(n.RawData(), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Receipts returns the receipts of the previous calls to fx in a function.
+func (p *Peer) Receipts(ctx context.Context, fnCid cid.Cid, fxName string) ([]*Receipt, error) {
+	prefix := receiptsKey.ChildString(fnCid.String()).ChildString(fxName)
+	res, err := p.store.Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	receipts := make([]*Receipt, 0, len(entries))
+	for _, e := range entries {
+		c, err := cid.Cast(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		r, err := p.GetReceipt(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, r)
+	}
+	return receipts, nil
+}
+
+// newReceipt creates the receipt of a call that just finished.
+func newReceipt(fnCid cid.Cid, fxName string, argsCid []cid.Cid, output cid.Cid, execTime time.Duration) *Receipt {
+	return &Receipt{
+		Fn:       fnCid,
+		Fx:       fxName,
+		Args:     argsCid,
+		Output:   output,
+		ExecTime: int64(execTime),
+		Time:     time.Now().Unix(),
+	}
+}
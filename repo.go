@@ -0,0 +1,124 @@
+package ipfslite
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// OpenPeer starts a peer keeping its identity and datastore in repo and
+// listening on listen, for the command line tools. cfg may be nil. Unless
+// cfg.Offline, the peer bootstraps to the default peers. The closer returned
+// closes the host and the datastore once ctx is done.
+func OpenPeer(ctx context.Context, repo, listen string, cfg *Config) (*Peer, io.Closer, error) {
+	// Bootstrappers are using 1024 keys. See:
+	// https://github.com/ipfs/infra/issues/378
+	crypto.MinRsaKeyBits = 1024
+
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if err := os.MkdirAll(repo, 0700); err != nil {
+		return nil, nil, err
+	}
+	priv, err := loadIdentity(filepath.Join(repo, "identity"))
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := multiaddr.NewMultiaddr(listen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ds, err := BadgerDatastore(filepath.Join(repo, "datastore"))
+	if err != nil {
+		return nil, nil, err
+	}
+	h, dht, err := SetupLibp2p(ctx, priv, nil, []multiaddr.Multiaddr{addr}, ds, Libp2pOptionsExtra...)
+	if err != nil {
+		ds.Close()
+		return nil, nil, err
+	}
+	closer := &repoCloser{h: h, ds: ds}
+
+	if cfg.PubSub == nil {
+		if cfg.PubSub, err = NewGossipSub(ctx, h); err != nil {
+			closer.Close()
+			return nil, nil, err
+		}
+	}
+	p, err := New(ctx, ds, h, dht, cfg)
+	if err != nil {
+		closer.Close()
+		return nil, nil, err
+	}
+	if !cfg.Offline {
+		p.Bootstrap(DefaultBootstrapPeers())
+	}
+	return p, closer, nil
+}
+
+// repoCloser closes what OpenPeer opened.
+type repoCloser struct {
+	h  host.Host
+	ds datastore.Batching
+}
+
+func (c *repoCloser) Close() error {
+	if err := c.h.Close(); err != nil {
+		c.ds.Close()
+		return err
+	}
+	return c.ds.Close()
+}
+
+// OpenCLI returns a CLI running commands on the daemon serving its API at
+// api if it's running, or else on a peer of its own opened with OpenPeer.
+// Close the CLI once ctx is done.
+func OpenCLI(ctx context.Context, api, repo, listen string, cfg *Config, out io.Writer) (*CLI, error) {
+	client := NewClient(api)
+	pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+	_, err := client.ID(pingCtx)
+	cancel()
+	if err == nil {
+		return NewClientCLI(client, out), nil
+	}
+
+	p, closer, err := OpenPeer(ctx, repo, listen, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c := NewCLI(p, out)
+	c.closer = closer
+	return c, nil
+}
+
+// loadIdentity reads the key of the peer, generating it on the first run so
+// the peer keeps its ID across restarts.
+func loadIdentity(path string) (crypto.PrivKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		return crypto.UnmarshalPrivateKey(b)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	priv, _, err := crypto.GenerateKeyPair(crypto.Ed25519, -1)
+	if err != nil {
+		return nil, err
+	}
+	b, err = crypto.MarshalPrivateKey(priv)
+	if err != nil {
+		return nil, err
+	}
+	return priv, ioutil.WriteFile(path, b, 0600)
+}
@@ -1,21 +1,20 @@
 package ipfslite
 
 import (
-	"bufio"
 	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/bytecodealliance/wasmtime-go"
 	"github.com/fxamacker/cbor"
 	"github.com/ipfs/go-cid"
-	peer "github.com/libp2p/go-libp2p-core/peer"
-	ma "github.com/multiformats/go-multiaddr"
 )
 
 // TODO: All of this data structures should be determined in IPLD.
@@ -24,6 +23,10 @@ import (
 type Type struct {
 	Name  string
 	Codec cid.Cid
+	// Schema defining the type, if any. Data is validated against it before
+	// and after calls.
+	Schema   *cid.Cid
+	Encoding string // EncodingDagCBOR (default) or EncodingDagJSON.
 }
 
 // // Data defined by its type and where the content is stored.
@@ -36,9 +39,21 @@ type Type struct {
 type FxABI struct {
 	// TODO: The FXs definition should be more complex to include their signature so they can return
 	// more than one value.
-	Fxs      []string // Name of the functions
-	Bytecode cid.Cid  // We could add a type here if we want to support several runtimes.
-	Args     []Type
+	Fxs        []string // Name of the functions
+	Bytecode   cid.Cid  // We could add a type here if we want to support several runtimes.
+	Args       []Type
+	Output     *Type
+	Convention CallConv // Calling convention of the toolchain that built the bytecode.
+	Deps       []Dep    // Library modules linked as imports when instantiating the bytecode.
+	Vectors    []Vector // Test vectors to verify the function.
+	Source     *Source  // Where the bytecode comes from, if known.
+	DebugInfo  *cid.Cid // Unstripped build of the bytecode with DWARF debug info, if any.
+}
+
+// Dep is a library module imported by a function under Name.
+type Dep struct {
+	Name     string
+	Bytecode cid.Cid
 }
 
 func (f *FxABI) Encode() (*bytes.Buffer, error) {
@@ -54,17 +69,25 @@ func (f *FxABI) Decode(r io.Reader) error {
 
 // Deploy a function to the network.
 func (p *Peer) Deploy(ctx context.Context, fxs []string, bytecode []byte, args []Type) (*cid.Cid, error) {
+	return p.DeployABI(ctx, FxABI{Fxs: fxs, Args: args}, bytecode)
+}
+
+// DeployABI deploys the bytecode and the ABI describing it. The Bytecode
+// field of the ABI is set to the CID of the deployed bytecode.
+func (p *Peer) DeployABI(ctx context.Context, abi FxABI, bytecode []byte) (*cid.Cid, error) {
+	if err := p.cfg.Policy.Check(bytecode, depNames(abi.Deps)...); err != nil {
+		return nil, err
+	}
+	if err := p.checkTypes(ctx, &abi); err != nil {
+		return nil, err
+	}
 	// TODO: Add an IPLD DAG instead of chunking files directly.
 	bytecodeCid, err := p.AddFile(ctx, bytes.NewReader(bytecode), &AddParams{})
-	fmt.Println("Bytecode deployed at: ", bytecodeCid)
 	if err != nil {
 		return nil, err
 	}
-	abi := FxABI{
-		Fxs:      fxs,
-		Bytecode: bytecodeCid.Cid(),
-		Args:     args,
-	}
+	logger.Debugf("bytecode deployed at %s", bytecodeCid.Cid())
+	abi.Bytecode = bytecodeCid.Cid()
 	// TODO: Use CBOR encoding better. As I abandoned IPLD because it was taking me too much
 	// will look into this while IPLD is supported.
 	// b, err := abi.Encode()
@@ -73,346 +96,326 @@ func (p *Peer) Deploy(ctx context.Context, fxs []string, bytecode []byte, args [
 		return nil, err
 	}
 	root, err := p.AddFile(ctx, bytes.NewReader(b), &AddParams{})
+	if err != nil {
+		return nil, err
+	}
 	rootCid := root.Cid()
-	fmt.Println("ABI deployed at: ", rootCid)
+	logger.Debugf("ABI deployed at %s", rootCid)
 
-	return &rootCid, err
+	return &rootCid, nil
 }
 
 // Call a function deployed in the network
 func (p *Peer) Call(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*cid.Cid, error) {
-	abi := FxABI{}
-	// Get the manifest.
-	rsc, err := p.GetFile(ctx, fnCid)
+	r, err := p.CallReceipt(ctx, fnCid, fxName, argsCid)
 	if err != nil {
 		return nil, err
 	}
-	defer rsc.Close()
-	d, err := ioutil.ReadAll(rsc)
-	err = json.Unmarshal(d, &abi)
-	// TODO: This depends on the encoding used for the ABI
-	//abi.Decode(rsc)
-	if err != nil {
-		return nil, err
+	return &r.Output, nil
+}
+
+// CallReceipt calls a function like Call, and returns the receipt of the call.
+func (p *Peer) CallReceipt(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*Receipt, error) {
+	r, _, err := p.CallProfile(ctx, fnCid, fxName, argsCid)
+	return r, err
+}
+
+// CallProfile calls a function like CallReceipt, and also returns the profile
+// of the call. Nested calls are profiled separately.
+func (p *Peer) CallProfile(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*Receipt, *Profile, error) {
+	pr := &Profile{}
+	ctx = withProfile(ctx, pr)
+	ctx, tree, done := p.callTree(ctx)
+	defer done()
+	if err := tree.enter(fnCid, fxName, argsCid); err != nil {
+		return nil, nil, err
 	}
+	defer tree.leave()
 
-	cids := append([]cid.Cid{abi.Bytecode}, argsCid...)
-	data := make([][]byte, 0)
+	abi, err := p.runnableABI(ctx, fnCid)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// Get the required data from the network.
-	for _, c := range cids {
-		rsc, err := p.GetFile(ctx, c)
+	inputs := make([][]byte, 0, len(argsCid))
+	for _, c := range argsCid {
+		d, err := p.fetchProfiled(ctx, c)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		defer rsc.Close()
-		d, err := ioutil.ReadAll(rsc)
-		if err != nil {
-			return nil, err
+		inputs = append(inputs, d)
+	}
+	for i, t := range abi.Args {
+		if i >= len(inputs) {
+			break
+		}
+		if err := p.validateData(ctx, t, inputs[i]); err != nil {
+			return nil, nil, fmt.Errorf("invalid argument %d: %w", i, err)
 		}
-		data = append(data, d)
 	}
 
-	module, err := wasmtime.NewModule(p.runtime.Engine, data[0])
+	ex, err := p.execute(ctx, abi, fxName, inputs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if abi.Output != nil {
+		if err := p.validateData(ctx, *abi.Output, ex.output); err != nil {
+			return nil, nil, fmt.Errorf("invalid output: %w", err)
+		}
+	}
 
-	instance, err := wasmtime.NewInstance(p.runtime, module, []*wasmtime.Extern{})
+	// Add cid to the network.
+	start := time.Now()
+	output, err := p.AddFile(ctx, bytes.NewReader(ex.output), &AddParams{})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	pr.OutputImport = time.Since(start)
 
-	call32 := func(f *wasmtime.Func, args ...interface{}) (int32, error) {
-		ret, err := f.Call(args...)
+	r := newReceipt(fnCid, fxName, argsCid, output.Cid(), ex.execTime)
+	if len(ex.log) > 0 {
+		l, err := p.AddFile(ctx, bytes.NewReader(ex.log), &AddParams{})
 		if err != nil {
-			return 0, err
+			return nil, nil, err
 		}
-		return ret.(int32), nil
+		logCid := l.Cid()
+		r.Log = &logCid
 	}
-
-	// Instantiate memory
-	memory := instance.GetExport("memory").Memory()
-	// Alloc function
-	alloc := instance.GetExport("alloc").Func()
-	// Function to call
-	fx := instance.GetExport(fxName).Func()
-
-	linearInput := []byte{}
-	argOffsets := make([]interface{}, 0)
-	// Concatenate inputs linearly
-	for _, k := range data[1:] {
-		linearInput = append(linearInput, k...)
-		// Offsets to get parameters inside WASM.
-		argOffsets = append(argOffsets, len(k))
+	if _, err := p.putReceipt(ctx, r); err != nil {
+		return nil, nil, err
 	}
+	return r, pr, nil
+}
 
-	// Allocating extra 100 just in case.
-	a, err := call32(alloc, len(linearInput)+100)
+// GetABI fetches and decodes the manifest of a deployed function.
+func (p *Peer) GetABI(ctx context.Context, fnCid cid.Cid) (*FxABI, error) {
+	abi := FxABI{}
+	// Get the manifest.
+	d, err := p.fetch(ctx, fnCid)
 	if err != nil {
-		fmt.Println("Error calling Wasm function")
 		return nil, err
 	}
-	buf := memory.UnsafeData()
-
-	// Allocate arguments in memory
-	for i, k := range linearInput {
-		buf[int(a)+i] = k
+	err = json.Unmarshal(d, &abi)
+	// TODO: This depends on the encoding used for the ABI
+	//abi.Decode(rsc)
+	if err != nil {
+		return nil, &ABIError{Fn: fnCid, Err: err}
 	}
+	return &abi, nil
+}
 
-	// Prepare arguments putting allocated pointer first
-	args := append([]interface{}{a}, argOffsets...)
-
-	b, err := call32(fx, args...)
+// putABI adds an ABI to the network.
+func (p *Peer) putABI(ctx context.Context, abi *FxABI) (*cid.Cid, error) {
+	b, err := json.Marshal(abi)
 	if err != nil {
-		fmt.Println("Error calling Wasm function")
 		return nil, err
 	}
-
-	// Add cid to the network.
-	output, err := p.AddFile(ctx, bytes.NewReader(buf[a:a+b]), &AddParams{})
-	outputCid := output.Cid()
-
+	n, err := p.AddFile(ctx, bytes.NewReader(b), &AddParams{})
 	if err != nil {
 		return nil, err
 	}
-	return &outputCid, nil
-
+	c := n.Cid()
+	return &c, nil
 }
 
-func checkArgs(args []string, l int) error {
-	if len(args) != l {
-		fmt.Println("Wrong number of arguments")
-		return fmt.Errorf("Wrong number of arguments")
+// fetch reads the whole file behind a CID.
+func (p *Peer) fetch(ctx context.Context, c cid.Cid) ([]byte, error) {
+	rsc, err := p.GetFile(ctx, c)
+	if err != nil {
+		return nil, &FetchError{Cid: c, Err: err}
 	}
-	return nil
+	defer rsc.Close()
+	b, err := ioutil.ReadAll(rsc)
+	if err != nil {
+		return nil, &FetchError{Cid: c, Err: err}
+	}
+	return b, nil
 }
 
-// ExecCmd from script
-func (p *Peer) ExecCmd(ctx context.Context, text string, done chan bool) error {
-	text = strings.ReplaceAll(text, "\n", "")
-	// TODO: Do not trim spaces for now.
-	// text = strings.ReplaceAll(text, " ", "")
-	words := strings.Split(text, "_")
+// execution is the outcome of running a function.
+type execution struct {
+	output   []byte
+	execTime time.Duration
+	log      []byte
+}
 
-	// Defer notifying the that processing is finished.
-	if done != nil {
-		defer func() {
-			done <- true
-		}()
-	}
+// execute runs fxName from the function's bytecode over the inputs and
+// returns its raw output, the time it ran for and what it logged. The log is
+// also attached to the *TrapError if the function traps.
+func (p *Peer) execute(ctx context.Context, abi *FxABI, fxName string, inputs [][]byte) (*execution, error) {
+	ctx, tree, done := p.callTree(ctx)
+	defer done()
 
-	if words[0] == "exit" {
-		os.Exit(0)
+	pr := profileOf(ctx)
+	start := time.Now()
+	instance, g, err := p.instantiate(ctx, tree, abi)
+	if err != nil {
+		return nil, err
 	}
-	if words[0] == "help" {
-		helpcmd()
-		return nil
+	fx, err := exportedFunc(instance, fxName)
+	if err != nil {
+		return nil, err
 	}
-	if len(words) < 2 {
-		fmt.Println("Wrong number of arguments")
-		return fmt.Errorf("Wrong number of arguments")
+	if pr != nil {
+		pr.Instantiate = time.Since(start)
 	}
 
-	// If we use add we can add random content to the network.
-	if words[0] == "addFile" {
-		bytecode, err := ioutil.ReadFile(words[1])
-		if err != nil {
-			fmt.Println("Couldn't read file: ", err)
-			return err
-		}
-
-		cid, err := p.AddFile(ctx, bytes.NewReader(bytecode), nil)
-		if err != nil {
-			fmt.Println("Couldn't add file to IPFS: ", err)
-			return err
-		}
-		fmt.Println("Added file with CID: ", cid)
-
-	} else if words[0] == "add" {
-		bytecode := []byte(words[1])
-		cid, err := p.AddFile(ctx, bytes.NewReader(bytecode), nil)
-		if err != nil {
-			fmt.Println("Couldn't add string to IPFS: ", err)
-			return err
-		}
-		fmt.Println("Added string with CID: ", cid)
-
-	} else if words[0] == "get" {
-		c, err := cid.Decode(string(words[1]))
-		if err != nil {
-			fmt.Println("Couldn't parse CID: ", err)
-			return err
-		}
-		rsc, err := p.GetFile(ctx, c)
-		d, err := ioutil.ReadAll(rsc)
-		if err != nil {
-			fmt.Println("Couldn't get file: ", err)
-			return err
-		}
-		fmt.Println("Get: ", string(d))
-
-	} else if words[0] == "abi" {
-
-		c, err := cid.Decode(string(words[1]))
-		if err != nil {
-			fmt.Println("Couldn't parse CID: ", err)
-			return err
-		}
-		rsc, err := p.GetFile(ctx, c)
-		d, err := ioutil.ReadAll(rsc)
-		abi := FxABI{}
-		err = json.Unmarshal(d, &abi)
-		// TODO: Change according to the encoding used for ABIs, ideally IPLD
-		// err = abi.Decode(rsc)
-		if err != nil {
-			fmt.Println("Couldn't decode ABI: ", err)
-			return err
-		}
-		fmt.Println("ABI: ", abi)
-	} else if words[0] == "deploy" {
-		if e := checkArgs(words, 4); e != nil {
-			return e
-		}
-		bytecode, err := ioutil.ReadFile(words[1])
-		if err != nil {
-			fmt.Println("Couldn't read file: ", err)
-			return err
-		}
-
-		fxIn := strings.Split(words[2], "&")
-		argsIn := strings.Split(words[3], "&")
-
-		args := []Type{}
-		for _, k := range argsIn {
-			args = append(args, Type{Name: k})
-		}
-
-		cid, err := p.Deploy(ctx, fxIn, bytecode, args)
-		if err != nil {
-			fmt.Println("Couldn't deploy to IPFS: ", err)
-			return err
-		}
-		fmt.Println("Deployed function at: ", cid)
-
-	} else if words[0] == "connect" {
-		p.connectCmd(ctx, words[1])
-
-	} else if words[0] == "script" {
-		// fmt.Println("This is still a work in progress...")
-		err := p.RunScript(ctx, words[1])
-		if err != nil {
-			return err
+	start = time.Now()
+	out, err := g.invoke(fx, inputs)
+	execTime := time.Since(start)
+	if pr != nil {
+		pr.Exec = execTime
+		pr.PeakMemoryPages = g.memory.Size()
+	}
+	if err != nil {
+		err = p.callError(ctx, err)
+		var trap *TrapError
+		if errors.As(err, &trap) {
+			trap.Log = g.logs.collect()
+			if p.cfg.Debug {
+				if err := p.symbolize(ctx, abi, trap); err != nil {
+					logger.Warnf("couldn't map backtrace to source: %s", err)
+				}
+			}
 		}
+		return nil, err
+	}
+	return &execution{output: out, execTime: execTime, log: g.logs.collect()}, nil
+}
 
-	} else if words[0] == "get" {
-		c, err := cid.Decode(string(words[1]))
-		if err != nil {
-			fmt.Println("Couldn't parse CID: ", err)
-			return err
-		}
-		rsc, err := p.GetFile(ctx, c)
-		d, err := ioutil.ReadAll(rsc)
-		if err != nil {
-			fmt.Println("Couldn't get file: ", err)
-			return err
-		}
-		fmt.Println("Get: ", string(d))
+// instantiate fetches and instantiates the bytecode of a function in the
+// store of the call tree.
+func (p *Peer) instantiate(ctx context.Context, tree *callTree, abi *FxABI) (*wasmtime.Instance, *guest, error) {
+	module, err := p.module(ctx, abi.Bytecode, depNames(abi.Deps)...)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	} else if words[0] == "call" {
-		if e := checkArgs(words, 4); e != nil {
-			return e
+	logs := newCallLog(p.cfg.MaxLogSize)
+	linker := wasmtime.NewLinker(tree.store)
+	if err := p.defineHostFuncs(ctx, tree, linker, logs); err != nil {
+		return nil, nil, err
+	}
+	deps, err := p.depModules(ctx, abi.Deps)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Libraries importing WASI need it even if the function doesn't.
+	wasi := importsWasi(module)
+	for _, m := range deps {
+		wasi = wasi || importsWasi(m)
+	}
+	if wasi {
+		if err := p.defineWasi(tree, linker, logs); err != nil {
+			return nil, nil, err
 		}
-		cids := []cid.Cid{}
+	}
+	if err := p.linkDeps(linker, abi.Deps, deps); err != nil {
+		return nil, nil, err
+	}
+	instance, err := linker.Instantiate(module)
+	if err != nil {
+		return nil, nil, err
+	}
 
-		fnCid, err := cid.Decode(string(words[1]))
-		if err != nil {
-			fmt.Println("Couldn't parse CID: ", err)
-			return err
-		}
+	g, err := newGuest(instance, abi.Convention)
+	if err != nil {
+		return nil, nil, err
+	}
+	g.logs = logs
+	g.maxPages = p.cfg.Policy.MaxMemoryPages
+	return instance, g, nil
+}
 
-		argsIn := strings.Split(words[3], "&")
-		// Parse CIDs
-		for _, cs := range argsIn {
-			c, err := cid.Decode(string(cs))
-			if err != nil {
-				fmt.Println("Couldn't parse CID: ", err)
-				return err
-			}
-			cids = append(cids, c)
-		}
+// moduleCache keeps the modules compiled by the peer, evicting the least
+// recently used ones past max.
+type moduleCache struct {
+	lk      sync.Mutex
+	max     int
+	recent  list.List // Of *cachedModule, most recently used first.
+	modules map[cid.Cid]*list.Element
+}
 
-		out, err := p.Call(ctx, fnCid, words[2], cids)
-		if err != nil {
-			fmt.Println("Couldn't run function: ", err)
-			return err
-		}
-		fmt.Println("Output CID: ", out.String())
+// cachedModule keeps the bytecode of a module along with it, so it can be
+// checked against the policy of the peer before each use.
+type cachedModule struct {
+	cid      cid.Cid
+	bytecode []byte
+	module   *wasmtime.Module
+}
 
-	} else {
-		fmt.Println("[!] Wrong command")
-		helpcmd()
+func (mc *moduleCache) get(c cid.Cid) (*cachedModule, bool) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+	e, ok := mc.modules[c]
+	if !ok {
+		return nil, false
 	}
-
-	return nil
+	mc.recent.MoveToFront(e)
+	return e.Value.(*cachedModule), true
 }
 
-func helpcmd() {
-	fmt.Println(`[!] Commands available:
-	* script_<file_dir>
-	* addFile_<file_dir>
-	* add_<string>
-	* get_<cid>
-	* abi_<cid>
-	* deploy_<bytecode>_<fn1>&<fn2>_<typeArg1>&<typeArg2>
-	* connect_<peer_multiaddr>
-	* call_<fxCid>_<fxname>_<argCid1>&<argCid2>
-	* exit`)
+// has tells if a module is cached without counting it as used.
+func (mc *moduleCache) has(c cid.Cid) bool {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+	_, ok := mc.modules[c]
+	return ok
 }
 
-// conectPeer connects to a peer in the network.
-func (p *Peer) connectCmd(ctx context.Context, id string) error {
-	maddr, err := ma.NewMultiaddr(id)
-	if err != nil {
-		fmt.Println("Invalid peer ID")
-		return err
+func (mc *moduleCache) put(c cid.Cid, bytecode []byte, m *wasmtime.Module) {
+	mc.lk.Lock()
+	defer mc.lk.Unlock()
+	if mc.modules == nil {
+		mc.modules = make(map[cid.Cid]*list.Element)
 	}
-	fmt.Println("Multiaddr", maddr)
-	addrInfo, err := peer.AddrInfoFromP2pAddr(maddr)
-	if err != nil {
-		fmt.Println("Invalid peer info", err)
-		return err
+	if e, ok := mc.modules[c]; ok {
+		e.Value = &cachedModule{cid: c, bytecode: bytecode, module: m}
+		mc.recent.MoveToFront(e)
+		return
 	}
-	err = p.ConnectPeer(*addrInfo)
-	if err != nil {
-		fmt.Println("Couldn't connect to peer", err)
-		return err
+	mc.modules[c] = mc.recent.PushFront(&cachedModule{cid: c, bytecode: bytecode, module: m})
+	for mc.max > 0 && mc.recent.Len() > mc.max {
+		oldest := mc.recent.Back()
+		mc.recent.Remove(oldest)
+		delete(mc.modules, oldest.Value.(*cachedModule).cid)
 	}
-	fmt.Println("Connected successfully to peer")
-	return nil
 }
 
-// RunScript IP Language
-func (p *Peer) RunScript(ctx context.Context, script string) error {
-
-	file, err := os.Open(script)
-	if err != nil {
-		fmt.Println("Couldn't run script", err)
-		return err
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		in := scanner.Text()
-		if in[0] != '#' {
-			err = p.ExecCmd(ctx, in, nil)
-			if err != nil {
-				return err
-			}
+// module returns the compiled module for some bytecode, fetching and
+// compiling it if it isn't cached. Cached modules are checked against the
+// policy too, as it may have changed since they were compiled. linked are the
+// names of the libraries the module can import from.
+func (p *Peer) module(ctx context.Context, bytecodeCid cid.Cid, linked ...string) (*wasmtime.Module, error) {
+	if cm, ok := p.modules.get(bytecodeCid); ok {
+		if err := p.cfg.Policy.Check(cm.bytecode, linked...); err != nil {
+			return nil, err
 		}
-		fmt.Println(in)
+		return cm.module, nil
 	}
+	bytecode, err := p.fetch(ctx, bytecodeCid)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cfg.Policy.Check(bytecode, linked...); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	m, err := wasmtime.NewModule(p.engine, bytecode)
+	if err != nil {
+		return nil, &CompileError{Bytecode: bytecodeCid, Err: err}
+	}
+	profileOf(ctx).addCompile(time.Since(start))
+	p.modules.put(bytecodeCid, bytecode, m)
+	return m, nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return err
+// exportedFunc returns the function exported with the given name.
+func exportedFunc(instance *wasmtime.Instance, name string) (*wasmtime.Func, error) {
+	fx := instance.GetExport(name)
+	if fx == nil || fx.Func() == nil {
+		return nil, &ExportError{Name: name, Kind: "function"}
 	}
-	return nil
+	return fx.Func(), nil
 }
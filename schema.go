@@ -0,0 +1,414 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagcbor"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+)
+
+// Encodings of the data validated against a schema.
+const (
+	EncodingDagCBOR = "dag-cbor"
+	EncodingDagJSON = "dag-json"
+)
+
+// Schema is an IPLD Schema in its JSON form, as described by the
+// schema-schema. For example:
+//
+//	{"types": {"Point": {"kind": "struct", "fields": {
+//		"x": {"type": "Int"},
+//		"y": {"type": "Int", "optional": true}
+//	}, "representation": {"map": {}}}}}
+//
+// TODO: Only structs with map representations, keyed unions, string enums,
+// lists, maps and the basic kinds are supported.
+type Schema struct {
+	Types map[string]*SchemaType `json:"types"`
+}
+
+// SchemaType is a type defined in a schema.
+type SchemaType struct {
+	Kind string `json:"kind"`
+
+	Fields map[string]*SchemaField `json:"fields,omitempty"` // Structs.
+
+	KeyType       string   `json:"keyType,omitempty"`   // Maps.
+	ValueType     *TypeRef `json:"valueType,omitempty"` // Lists and maps.
+	ValueNullable bool     `json:"valueNullable,omitempty"`
+
+	Members map[string]interface{} `json:"members,omitempty"` // Enums.
+
+	Representation map[string]json.RawMessage `json:"representation,omitempty"`
+}
+
+// SchemaField is a field of a struct.
+type SchemaField struct {
+	Type     TypeRef `json:"type"`
+	Optional bool    `json:"optional,omitempty"`
+	Nullable bool    `json:"nullable,omitempty"`
+}
+
+// TypeRef refers to a type by name, or defines an anonymous list or map
+// inline.
+type TypeRef struct {
+	Name   string
+	Inline *SchemaType
+}
+
+func (r *TypeRef) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &r.Name); err == nil {
+		return nil
+	}
+	r.Inline = &SchemaType{}
+	return json.Unmarshal(b, r.Inline)
+}
+
+func (r TypeRef) MarshalJSON() ([]byte, error) {
+	if r.Inline != nil {
+		return json.Marshal(r.Inline)
+	}
+	return json.Marshal(r.Name)
+}
+
+var builtinKinds = map[string]ipld.Kind{
+	"Bool":   ipld.Kind_Bool,
+	"Int":    ipld.Kind_Int,
+	"Float":  ipld.Kind_Float,
+	"String": ipld.Kind_String,
+	"Bytes":  ipld.Kind_Bytes,
+	"Link":   ipld.Kind_Link,
+}
+
+// SchemaError tells which part of some data doesn't match a schema.
+type SchemaError struct {
+	Path   string // e.g. .points[2].x
+	Reason string
+}
+
+func (e *SchemaError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "."
+	}
+	return fmt.Sprintf("%s: %s", path, e.Reason)
+}
+
+func schemaErrorf(path, format string, a ...interface{}) error {
+	return &SchemaError{Path: path, Reason: fmt.Sprintf(format, a...)}
+}
+
+// GetSchema fetches and decodes a schema.
+func (p *Peer) GetSchema(ctx context.Context, c cid.Cid) (*Schema, error) {
+	b, err := p.fetch(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schema{}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("couldn't decode schema %s: %s", c, err)
+	}
+	return s, nil
+}
+
+// Check makes sure typeName and every type it refers to are defined.
+func (s *Schema) Check(typeName string) error {
+	return s.checkRef(TypeRef{Name: typeName}, map[string]bool{})
+}
+
+func (s *Schema) checkRef(r TypeRef, seen map[string]bool) error {
+	if r.Inline != nil {
+		return s.checkType(r.Inline, seen)
+	}
+	if _, ok := builtinKinds[r.Name]; ok || r.Name == "Any" || seen[r.Name] {
+		return nil
+	}
+	t, ok := s.Types[r.Name]
+	if !ok {
+		return fmt.Errorf("type %s not defined in schema", r.Name)
+	}
+	seen[r.Name] = true
+	return s.checkType(t, seen)
+}
+
+func (s *Schema) checkType(t *SchemaType, seen map[string]bool) error {
+	switch t.Kind {
+	case "bool", "int", "float", "string", "bytes", "link", "enum":
+	case "struct":
+		if _, ok := t.Representation["map"]; !ok && t.Representation != nil {
+			return fmt.Errorf("unsupported struct representation")
+		}
+		for _, f := range t.Fields {
+			if err := s.checkRef(f.Type, seen); err != nil {
+				return err
+			}
+		}
+	case "list", "map":
+		if t.ValueType == nil {
+			return fmt.Errorf("%s without a value type", t.Kind)
+		}
+		return s.checkRef(*t.ValueType, seen)
+	case "union":
+		members, err := t.keyedMembers()
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if err := s.checkRef(TypeRef{Name: m}, seen); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported kind %q", t.Kind)
+	}
+	return nil
+}
+
+// keyedMembers returns the members of a union with a keyed representation.
+func (t *SchemaType) keyedMembers() (map[string]string, error) {
+	raw, ok := t.Representation["keyed"]
+	if !ok {
+		return nil, fmt.Errorf("unsupported union representation")
+	}
+	members := map[string]string{}
+	return members, json.Unmarshal(raw, &members)
+}
+
+// Validate checks that a node is of the type typeName.
+func (s *Schema) Validate(typeName string, n ipld.Node) error {
+	return s.validateRef(TypeRef{Name: typeName}, n, "")
+}
+
+func (s *Schema) validateRef(r TypeRef, n ipld.Node, path string) error {
+	if r.Inline != nil {
+		return s.validateType(r.Inline, n, path)
+	}
+	if r.Name == "Any" {
+		return nil
+	}
+	if k, ok := builtinKinds[r.Name]; ok {
+		return expectKind(n, k, path)
+	}
+	t, ok := s.Types[r.Name]
+	if !ok {
+		return schemaErrorf(path, "type %s not defined in schema", r.Name)
+	}
+	return s.validateType(t, n, path)
+}
+
+func expectKind(n ipld.Node, k ipld.Kind, path string) error {
+	if n.Kind() != k {
+		return schemaErrorf(path, "expected %s, got %s", k, n.Kind())
+	}
+	return nil
+}
+
+func (s *Schema) validateType(t *SchemaType, n ipld.Node, path string) error {
+	switch t.Kind {
+	case "bool":
+		return expectKind(n, ipld.Kind_Bool, path)
+	case "int":
+		return expectKind(n, ipld.Kind_Int, path)
+	case "float":
+		return expectKind(n, ipld.Kind_Float, path)
+	case "string":
+		return expectKind(n, ipld.Kind_String, path)
+	case "bytes":
+		return expectKind(n, ipld.Kind_Bytes, path)
+	case "link":
+		return expectKind(n, ipld.Kind_Link, path)
+
+	case "enum":
+		if err := expectKind(n, ipld.Kind_String, path); err != nil {
+			return err
+		}
+		v, _ := n.AsString()
+		if _, ok := t.Members[v]; !ok {
+			return schemaErrorf(path, "%q is not a member of the enum", v)
+		}
+		return nil
+
+	case "struct":
+		if err := expectKind(n, ipld.Kind_Map, path); err != nil {
+			return err
+		}
+		seen := map[string]bool{}
+		for it := n.MapIterator(); !it.Done(); {
+			k, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			name, _ := k.AsString()
+			f, ok := t.Fields[name]
+			if !ok {
+				return schemaErrorf(path+"."+name, "unknown field")
+			}
+			seen[name] = true
+			if v.IsNull() {
+				if !f.Nullable {
+					return schemaErrorf(path+"."+name, "field is not nullable")
+				}
+				continue
+			}
+			if err := s.validateRef(f.Type, v, path+"."+name); err != nil {
+				return err
+			}
+		}
+		for name, f := range t.Fields {
+			if !seen[name] && !f.Optional {
+				return schemaErrorf(path+"."+name, "missing required field")
+			}
+		}
+		return nil
+
+	case "list":
+		if err := expectKind(n, ipld.Kind_List, path); err != nil {
+			return err
+		}
+		for it := n.ListIterator(); !it.Done(); {
+			i, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if err := s.validateValue(t, v, path+"["+strconv.FormatInt(i, 10)+"]"); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "map":
+		if err := expectKind(n, ipld.Kind_Map, path); err != nil {
+			return err
+		}
+		for it := n.MapIterator(); !it.Done(); {
+			k, v, err := it.Next()
+			if err != nil {
+				return err
+			}
+			key, _ := k.AsString()
+			if t.KeyType != "" && t.KeyType != "String" {
+				if err := s.validateRef(TypeRef{Name: t.KeyType}, k, path+"."+key); err != nil {
+					return err
+				}
+			}
+			if err := s.validateValue(t, v, path+"."+key); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "union":
+		if err := expectKind(n, ipld.Kind_Map, path); err != nil {
+			return err
+		}
+		members, err := t.keyedMembers()
+		if err != nil {
+			return schemaErrorf(path, "%s", err)
+		}
+		if n.Length() != 1 {
+			return schemaErrorf(path, "keyed union must have exactly one key, got %d", n.Length())
+		}
+		k, v, err := n.MapIterator().Next()
+		if err != nil {
+			return err
+		}
+		key, _ := k.AsString()
+		member, ok := members[key]
+		if !ok {
+			return schemaErrorf(path+"."+key, "unknown union member")
+		}
+		return s.validateRef(TypeRef{Name: member}, v, path+"."+key)
+	}
+	return schemaErrorf(path, "unsupported kind %q", t.Kind)
+}
+
+// validateValue checks a value of a list or a map.
+func (s *Schema) validateValue(t *SchemaType, v ipld.Node, path string) error {
+	if v.IsNull() {
+		if !t.ValueNullable {
+			return schemaErrorf(path, "value is not nullable")
+		}
+		return nil
+	}
+	return s.validateRef(*t.ValueType, v, path)
+}
+
+// decodeNode decodes dag-cbor or dag-json data. Data is assumed to be
+// dag-cbor when no encoding is given.
+func decodeNode(data []byte, encoding string) (ipld.Node, error) {
+	nb := basicnode.Prototype__Any{}.NewBuilder()
+	var err error
+	switch encoding {
+	case "", EncodingDagCBOR:
+		err = dagcbor.Decoder(nb, bytes.NewReader(data))
+	case EncodingDagJSON:
+		err = dagjson.Decoder(nb, bytes.NewReader(data))
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nb.Build(), nil
+}
+
+// validateData checks that some data is of the given type. Types without a
+// schema accept any data.
+func (p *Peer) validateData(ctx context.Context, t Type, data []byte) error {
+	if t.Schema == nil {
+		return nil
+	}
+	s, err := p.GetSchema(ctx, *t.Schema)
+	if err != nil {
+		return err
+	}
+	n, err := decodeNode(data, t.Encoding)
+	if err != nil {
+		return fmt.Errorf("couldn't decode %s: %s", t.Name, err)
+	}
+	return s.Validate(t.Name, n)
+}
+
+// checkTypes makes sure the schemas of the arguments and output of a
+// function define their types.
+func (p *Peer) checkTypes(ctx context.Context, abi *FxABI) error {
+	types := abi.Args
+	if abi.Output != nil {
+		types = append(append([]Type{}, types...), *abi.Output)
+	}
+	for _, t := range types {
+		if t.Schema == nil {
+			continue
+		}
+		s, err := p.GetSchema(ctx, *t.Schema)
+		if err != nil {
+			return err
+		}
+		if err := s.Check(t.Name); err != nil {
+			return fmt.Errorf("invalid schema for %s: %s", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// parseType parses a type given as <name>[@<schemaCid>].
+func parseType(s string) (Type, error) {
+	parts := strings.SplitN(s, "@", 2)
+	t := Type{Name: parts[0]}
+	if len(parts) == 2 {
+		c, err := cid.Decode(parts[1])
+		if err != nil {
+			return t, err
+		}
+		t.Schema = &c
+	}
+	return t, nil
+}
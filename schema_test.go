@@ -0,0 +1,67 @@
+package ipfslite
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const testSchema = `{"types": {
+	"Shape": {"kind": "struct", "fields": {
+		"name": {"type": "String"},
+		"color": {"type": "Color", "optional": true},
+		"points": {"type": {"kind": "list", "valueType": "Point"}}
+	}, "representation": {"map": {}}},
+	"Point": {"kind": "struct", "fields": {
+		"x": {"type": "Int"},
+		"y": {"type": "Int"}
+	}, "representation": {"map": {}}},
+	"Color": {"kind": "enum", "members": {"red": null, "blue": null}, "representation": {"string": {}}}
+}}`
+
+func TestSchemaValidate(t *testing.T) {
+	s := &Schema{}
+	if err := json.Unmarshal([]byte(testSchema), s); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check("Shape"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check("Circle"); err == nil {
+		t.Error("expected an error for an undefined type")
+	}
+
+	tests := []struct {
+		data  string
+		valid bool
+		path  string // Where the error is.
+	}{
+		{`{"name": "square", "color": "red", "points": [{"x": 0, "y": 0}, {"x": 1, "y": 1}]}`, true, ""},
+		{`{"name": "square", "points": [{"x": 0, "y": 0}, {"x": 1, "y": "1"}]}`, false, ".points[1].y"},
+		{`{"name": "square", "color": "green", "points": []}`, false, ".color"},
+		{`{"name": "square"}`, false, ".points"},
+		{`{"name": "square", "points": [], "size": 2}`, false, ".size"},
+		{`[]`, false, ""},
+	}
+	for _, test := range tests {
+		n, err := decodeNode([]byte(test.data), EncodingDagJSON)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.Validate("Shape", n)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error %s", test.data, err)
+			}
+			continue
+		}
+		serr := &SchemaError{}
+		if !errors.As(err, &serr) {
+			t.Errorf("%s: expected a schema error, got %v", test.data, err)
+			continue
+		}
+		if serr.Path != test.path {
+			t.Errorf("%s: expected error at %s, got %s", test.data, test.path, err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package ipfslite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	ipld "github.com/ipfs/go-ipld-format"
+	uio "github.com/ipfs/go-unixfs/io"
+)
+
+// Source links a bytecode to the source tree it was built from, so auditors
+// can rebuild it and check what the function does.
+type Source struct {
+	Tree      cid.Cid // UnixFS directory with the sources, e.g. a Cargo project.
+	Toolchain string  // e.g. "rustc 1.48.0".
+	Build     string  // Command run in the tree to build the bytecode.
+}
+
+func (s *Source) String() string {
+	return fmt.Sprintf("Source tree: %s\nToolchain: %s\nBuild: %s", s.Tree, s.Toolchain, s.Build)
+}
+
+// AddSourceTree adds a directory to the network as a UnixFS directory. Hidden
+// files and target directories, where Cargo leaves its build artifacts, are
+// skipped.
+func (p *Peer) AddSourceTree(ctx context.Context, dir string) (ipld.Node, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	d := uio.NewDirectory(p)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") || (e.IsDir() && e.Name() == "target") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		var n ipld.Node
+		if e.IsDir() {
+			n, err = p.AddSourceTree(ctx, path)
+		} else {
+			n, err = p.addLocalFile(ctx, path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := d.AddChild(ctx, e.Name(), n); err != nil {
+			return nil, err
+		}
+	}
+	n, err := d.GetNode()
+	if err != nil {
+		return nil, err
+	}
+	return n, p.Add(ctx, n)
+}
+
+func (p *Peer) addLocalFile(ctx context.Context, path string) (ipld.Node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return p.AddFile(ctx, f, &AddParams{})
+}
+
+// GetSourceTree writes a UnixFS directory to dir.
+func (p *Peer) GetSourceTree(ctx context.Context, c cid.Cid, dir string) error {
+	n, err := p.Get(ctx, c)
+	if err != nil {
+		return err
+	}
+	d, err := uio.NewDirectoryFromNode(p, n)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return d.ForEachLink(ctx, func(l *ipld.Link) error {
+		if l.Name != filepath.Base(l.Name) || l.Name == ".." {
+			return fmt.Errorf("invalid name in source tree: %q", l.Name)
+		}
+		path := filepath.Join(dir, l.Name)
+
+		child, err := p.Get(ctx, l.Cid)
+		if err != nil {
+			return err
+		}
+		if _, err := uio.NewDirectoryFromNode(p, child); err == nil {
+			return p.GetSourceTree(ctx, l.Cid, path)
+		} else if err != uio.ErrNotADir {
+			return err
+		}
+
+		rsc, err := p.GetFile(ctx, l.Cid)
+		if err != nil {
+			return err
+		}
+		defer rsc.Close()
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(f, rsc)
+		return err
+	})
+}
+
+// SetSource deploys a copy of the ABI of a function linking it to its
+// source. It returns the CID of the new ABI.
+func (p *Peer) SetSource(ctx context.Context, fnCid cid.Cid, src Source) (*cid.Cid, error) {
+	abi, err := p.GetABI(ctx, fnCid)
+	if err != nil {
+		return nil, err
+	}
+	abi.Source = &src
+	return p.putABI(ctx, abi)
+}
@@ -0,0 +1,64 @@
+package ipfslite
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceTree(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+
+	src, err := ioutil.TempDir("", "source")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	files := map[string]string{
+		"Cargo.toml":  "[package]\nname = \"simple\"\n",
+		"src/lib.rs":  "pub fn fx() {}\n",
+		"target/x.so": "build output",
+		".git/HEAD":   "ref: refs/heads/master\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := p.AddSourceTree(ctx, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := ioutil.TempDir("", "fetched")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dst)
+	if err := p.GetSourceTree(ctx, n.Cid(), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Cargo.toml", "src/lib.rs"} {
+		b, err := ioutil.ReadFile(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != files[name] {
+			t.Errorf("%s: got %q", name, b)
+		}
+	}
+	for _, name := range []string{"target", ".git"} {
+		if _, err := os.Stat(filepath.Join(dst, name)); !os.IsNotExist(err) {
+			t.Errorf("%s shouldn't be part of the source tree", name)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	chunker "github.com/ipfs/go-ipfs-chunker"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+	"github.com/ipfs/go-unixfs"
+)
+
+// Fold streams a UnixFS file to a function leaf by leaf, so the file never
+// needs to be loaded in memory, neither in the host nor in the guest.
+//
+// The function must export three functions: fx_init receives the args
+// following the calling convention of the ABI and sets up the accumulator,
+// fx_step is called with a (ptr, len) pair for the data of every leaf of the
+// input, and fx_finish returns the output following the calling convention.
+// Functions writing their result in place write it over the buffer used to
+// pass the leaves.
+func (p *Peer) Fold(ctx context.Context, fnCid cid.Cid, fxName string, input cid.Cid, argsCid []cid.Cid) (*cid.Cid, error) {
+	ctx, tree, done := p.callTree(ctx)
+	defer done()
+	if err := tree.enter(fnCid, fxName, append([]cid.Cid{input}, argsCid...)); err != nil {
+		return nil, err
+	}
+	defer tree.leave()
+
+	abi, err := p.runnableABI(ctx, fnCid)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([][]byte, 0, len(argsCid))
+	for _, c := range argsCid {
+		d, err := p.fetch(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, d)
+	}
+
+	instance, g, err := p.instantiate(ctx, tree, abi)
+	if err != nil {
+		return nil, err
+	}
+	initFx, err := exportedFunc(instance, fxName+"_init")
+	if err != nil {
+		return nil, err
+	}
+	step, err := exportedFunc(instance, fxName+"_step")
+	if err != nil {
+		return nil, err
+	}
+	finish, err := exportedFunc(instance, fxName+"_finish")
+	if err != nil {
+		return nil, err
+	}
+
+	// The buffer used to pass leaves is allocated first so in place results
+	// are written over it.
+	buf, err := g.malloc(int(chunker.DefaultBlockSize))
+	if err != nil {
+		return nil, err
+	}
+
+	args, err := g.pushArgs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := g.call(initFx, args...); err != nil {
+		return nil, p.callError(ctx, err)
+	}
+
+	err = p.walkLeaves(ctx, input, func(leaf ipld.Node, data []byte) error {
+		if int32(len(data)) > g.allocated[0].size {
+			// Leaves are bounded by the chunker used to import the file, so
+			// the buffer only grows a few times.
+			if err := g.release(g.allocated[0]); err != nil {
+				return err
+			}
+			buf, err = g.malloc(len(data))
+			if err != nil {
+				return err
+			}
+			// Keep the buffer as the first region.
+			last := len(g.allocated) - 1
+			g.allocated = append([]region{g.allocated[last]}, g.allocated[:last]...)
+		}
+		if err := g.write(buf, data); err != nil {
+			return err
+		}
+		if _, err := g.call(step, buf, int32(len(data))); err != nil {
+			return p.callError(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := g.call(finish)
+	if err != nil {
+		return nil, p.callError(ctx, err)
+	}
+	out, err := g.output(ret)
+	if err != nil {
+		return nil, err
+	}
+	if err := g.free(); err != nil {
+		return nil, err
+	}
+
+	output, err := p.AddFile(ctx, bytes.NewReader(out), &AddParams{})
+	if err != nil {
+		return nil, err
+	}
+	outputCid := output.Cid()
+	return &outputCid, nil
+}
+
+// walkLeaves calls f with the data of every leaf of a UnixFS file, in order.
+// Nodes are fetched as they are visited, so only a branch of the DAG is held
+// in memory at a time.
+func (p *Peer) walkLeaves(ctx context.Context, root cid.Cid, f func(leaf ipld.Node, data []byte) error) error {
+	n, err := p.Get(ctx, root)
+	if err != nil {
+		return err
+	}
+	data, err := nodeData(n)
+	if err != nil {
+		return err
+	}
+	if len(n.Links()) == 0 {
+		return f(n, data)
+	}
+	// Intermediate nodes may carry some data before their children.
+	if len(data) > 0 {
+		if err := f(n, data); err != nil {
+			return err
+		}
+	}
+	for _, l := range n.Links() {
+		if err := p.walkLeaves(ctx, l.Cid, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nodeData returns the file data held by a node of a UnixFS DAG.
+func nodeData(n ipld.Node) ([]byte, error) {
+	switch n := n.(type) {
+	case *merkledag.RawNode:
+		return n.RawData(), nil
+	case *merkledag.ProtoNode:
+		fsn, err := unixfs.FSNodeFromBytes(n.Data())
+		if err != nil {
+			return nil, err
+		}
+		return fsn.Data(), nil
+	default:
+		return nil, fmt.Errorf("%s is not a UnixFS node", n.Cid())
+	}
+}
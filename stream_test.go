@@ -0,0 +1,142 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	blockservice "github.com/ipfs/go-blockservice"
+	"github.com/ipfs/go-cid"
+	datastore "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	offline "github.com/ipfs/go-ipfs-exchange-offline"
+	ipld "github.com/ipfs/go-ipld-format"
+	"github.com/ipfs/go-merkledag"
+)
+
+// dagPeer returns an offline Peer with just a DAG service, for tests that
+// don't need a network or a runtime.
+func dagPeer(t *testing.T) *Peer {
+	store := dssync.MutexWrap(datastore.NewMapDatastore())
+	bs := blockstore.NewIdStore(blockstore.NewBlockstore(store))
+	p := &Peer{
+		ctx:    context.Background(),
+		cfg:    &Config{Offline: true},
+		store:  store,
+		bstore: bs,
+		bserv:  blockservice.New(bs, offline.Exchange(bs)),
+	}
+	p.cfg.setDefaults()
+	p.DAGService = merkledag.NewDAGService(p.bserv)
+	return p
+}
+
+func TestWalkLeaves(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	n, err := p.AddFile(ctx, bytes.NewReader(content), &AddParams{Chunker: "size-64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var leaves int
+	var got []byte
+	err = p.walkLeaves(ctx, n.Cid(), func(leaf ipld.Node, data []byte) error {
+		leaves++
+		got = append(got, data...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leaves != 16 {
+		t.Errorf("expected 16 leaves, got %d", leaves)
+	}
+	if !bytes.Equal(content, got) {
+		t.Error("leaves don't add up to the original content")
+	}
+}
+
+// statsWat exports a fold counting the leaves and bytes of a file and adding
+// up its bytes, starting from the length of its argument.
+const statsWat = `(module
+	(memory (export "memory") 8)
+	(global $heap (mut i32) (i32.const 1024))
+	(global $buf (mut i32) (i32.const 0))
+	(global $leaves (mut i32) (i32.const 0))
+	(global $bytes (mut i32) (i32.const 0))
+	(global $sum (mut i32) (i32.const 0))
+	(func (export "alloc") (param $size i32) (result i32)
+		(local $ptr i32)
+		(local.set $ptr (global.get $heap))
+		(global.set $heap (i32.add (global.get $heap) (local.get $size)))
+		(local.get $ptr))
+	(func (export "stats_init") (param $ptr i32) (param $len i32)
+		(global.set $sum (local.get $len)))
+	(func (export "stats_step") (param $ptr i32) (param $len i32)
+		(local $i i32)
+		(global.set $buf (local.get $ptr))
+		(global.set $leaves (i32.add (global.get $leaves) (i32.const 1)))
+		(global.set $bytes (i32.add (global.get $bytes) (local.get $len)))
+		(block $done
+			(loop $next
+				(br_if $done (i32.eq (local.get $i) (local.get $len)))
+				(global.set $sum (i32.add (global.get $sum)
+					(i32.load8_u (i32.add (local.get $ptr) (local.get $i)))))
+				(local.set $i (i32.add (local.get $i) (i32.const 1)))
+				(br $next))))
+	(func (export "stats_finish") (result i32)
+		(i32.store (global.get $buf) (global.get $leaves))
+		(i32.store offset=4 (global.get $buf) (global.get $bytes))
+		(i32.store offset=8 (global.get $buf) (global.get $sum))
+		(i32.const 12)))`
+
+func TestFold(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	fn := deployWat(t, p, statsWat, FxABI{Fxs: []string{"stats"}})
+
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	n, err := p.AddFile(ctx, bytes.NewReader(content), &AddParams{Chunker: "size-64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seed, err := p.AddFile(ctx, bytes.NewReader([]byte("seed")), &AddParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := p.Fold(ctx, fn, "stats", n.Cid(), []cid.Cid{seed.Cid()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := p.GetFile(ctx, *out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != 12 {
+		t.Fatalf("unexpected output %x", b)
+	}
+	sum := uint32(len("seed"))
+	for _, c := range content {
+		sum += uint32(c)
+	}
+	if leaves := binary.LittleEndian.Uint32(b); leaves != 16 {
+		t.Errorf("expected 16 leaves, got %d", leaves)
+	}
+	if size := binary.LittleEndian.Uint32(b[4:]); size != uint32(len(content)) {
+		t.Errorf("expected %d bytes, got %d", len(content), size)
+	}
+	if s := binary.LittleEndian.Uint32(b[8:]); s != sum {
+		t.Errorf("expected a sum of %d, got %d", sum, s)
+	}
+}
@@ -0,0 +1,97 @@
+package ipfslite
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ipfs/go-cid"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	ipld "github.com/ipfs/go-ipld-format"
+	multihash "github.com/multiformats/go-multihash"
+)
+
+// thunkType tags dag-cbor nodes holding a thunk.
+const thunkType = "thunk"
+
+func init() {
+	cbornode.RegisterCborType(Thunk{})
+}
+
+// ErrThunk is returned when some content is a thunk that the peer doesn't
+// evaluate on demand, see Config.EvalThunks.
+var ErrThunk = errors.New("thunks are only evaluated on demand with EvalThunks")
+
+type forceKey struct{}
+
+// forcing tells if a thunk is being forced, in which case the thunks it takes
+// as arguments are evaluated too.
+func forcing(ctx context.Context) bool {
+	_, ok := ctx.Value(forceKey{}).(bool)
+	return ok
+}
+
+// Thunk is an unevaluated call. It is stored as a dag-cbor node and its CID
+// can be used anywhere a CID is accepted: with Config.EvalThunks, GetFile,
+// and therefore Call, evaluate thunks on demand and continue with their
+// output. Arguments may be thunks themselves.
+type Thunk struct {
+	Type string
+	Fn   cid.Cid
+	Fx   string
+	Args []cid.Cid
+}
+
+// NewThunk adds a thunk for a call to the network without evaluating it.
+func (p *Peer) NewThunk(ctx context.Context, fnCid cid.Cid, fxName string, argsCid []cid.Cid) (*cid.Cid, error) {
+	t := &Thunk{Type: thunkType, Fn: fnCid, Fx: fxName, Args: argsCid}
+	n, err := cbornode.WrapObject(t, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Add(ctx, n); err != nil {
+		return nil, err
+	}
+	c := n.Cid()
+	return &c, nil
+}
+
+// Force evaluates c if it is a thunk and returns the CID of its output, along
+// with the thunks it takes as arguments, even without Config.EvalThunks. Any
+// other CID is returned as is.
+func (p *Peer) Force(ctx context.Context, c cid.Cid) (*cid.Cid, error) {
+	ctx = context.WithValue(ctx, forceKey{}, true)
+	n, err := p.Get(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := asThunk(n)
+	if !ok {
+		return &c, nil
+	}
+	return p.evalThunk(ctx, c, t)
+}
+
+// evalThunk evaluates a thunk, memoizing its output.
+func (p *Peer) evalThunk(ctx context.Context, c cid.Cid, t *Thunk) (*cid.Cid, error) {
+	key := thunkType + "/" + c.String()
+	if out, ok, err := p.memoGet(key); err != nil || ok {
+		return out, err
+	}
+	out, err := p.CallMemoized(ctx, t.Fn, t.Fx, t.Args)
+	if err != nil {
+		return nil, err
+	}
+	return out, p.memoPut(key, *out)
+}
+
+// asThunk decodes a node as a thunk.
+func asThunk(n ipld.Node) (*Thunk, bool) {
+	if n.Cid().Type() != cid.DagCBOR {
+		return nil, false
+	}
+	t := Thunk{}
+	if err := cbornode.DecodeInto(n.RawData(), &t); err != nil || t.Type != thunkType {
+		return nil, false
+	}
+	return &t, true
+}
@@ -0,0 +1,52 @@
+package ipfslite
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestThunkDetection(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+
+	fn, err := cid.Decode("bafybeigft6kodyhajn5m2fx6raevfcj6umdob2jiuntufbvttwpygz767q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, err := p.NewThunk(ctx, fn, "fx", []cid.Cid{fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := p.Get(ctx, *tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	th, ok := asThunk(n)
+	if !ok {
+		t.Fatal("thunk not detected")
+	}
+	if !th.Fn.Equals(fn) || th.Fx != "fx" || len(th.Args) != 1 {
+		t.Errorf("unexpected thunk: %+v", th)
+	}
+
+	// Thunks are only evaluated when asked to.
+	if _, err := p.GetFile(ctx, *tc); !errors.Is(err, ErrThunk) {
+		t.Errorf("expected the thunk not to be evaluated, got %v", err)
+	}
+
+	// Other dag-cbor nodes are not thunks.
+	ec, err := p.appendActorEntry(ctx, actorsKey.ChildString("test"), &ActorEntry{Fn: fn, Fx: "fx", State: fn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err = p.Get(ctx, *ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := asThunk(n); ok {
+		t.Error("actor entry detected as a thunk")
+	}
+}
@@ -0,0 +1,163 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipfs/go-datastore"
+)
+
+// RuntimeVersion identifies the runtime functions are verified against.
+// Vectors passing on one version may fail on another one.
+const RuntimeVersion = "wasmtime-go/v0.22.0"
+
+var verifiedKey = datastore.NewKey("/verified").ChildString(RuntimeVersion)
+
+// Vector is a test vector of a function: calling Fx with Args is expected to
+// return the content of Output.
+type Vector struct {
+	Fx     string
+	Args   []cid.Cid
+	Output cid.Cid
+}
+
+// VectorResult is the outcome of running a test vector.
+type VectorResult struct {
+	Vector
+	Pass bool
+	Err  string `json:",omitempty"` // Why the vector failed.
+}
+
+// VerifyReport has the results of running every test vector of a function.
+type VerifyReport struct {
+	Fn      cid.Cid
+	Results []VectorResult
+}
+
+// Pass is true when every vector passed.
+func (r *VerifyReport) Pass() bool {
+	for _, res := range r.Results {
+		if !res.Pass {
+			return false
+		}
+	}
+	return true
+}
+
+// String prints the report in a human readable way.
+func (r *VerifyReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Verified %d vectors of %s on %s", len(r.Results), r.Fn, RuntimeVersion)
+	for _, res := range r.Results {
+		if res.Pass {
+			fmt.Fprintf(&b, "\n  PASS %s(%s)", res.Fx, cidsString(res.Args))
+		} else {
+			fmt.Fprintf(&b, "\n  FAIL %s(%s): %s", res.Fx, cidsString(res.Args), res.Err)
+		}
+	}
+	return b.String()
+}
+
+func cidsString(cids []cid.Cid) string {
+	s := make([]string, 0, len(cids))
+	for _, c := range cids {
+		s = append(s, c.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// Verify runs every test vector in the ABI of a function. Outputs are compared
+// by content, so they don't depend on how the expected output was chunked.
+// Vectors are run without memoizing or recording receipts. If a vector can't
+// run, because something can't be fetched or ctx is done, the error is
+// returned instead of a report.
+func (p *Peer) Verify(ctx context.Context, fnCid cid.Cid) (*VerifyReport, error) {
+	abi, err := p.GetABI(ctx, fnCid)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &VerifyReport{Fn: fnCid}
+	for _, v := range abi.Vectors {
+		res := VectorResult{Vector: v}
+		err := p.runVector(ctx, abi, v)
+		var fetchErr *FetchError
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if errors.As(err, &fetchErr) {
+			return nil, err
+		}
+		res.Pass = err == nil
+		if err != nil {
+			res.Err = err.Error()
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report, nil
+}
+
+func (p *Peer) runVector(ctx context.Context, abi *FxABI, v Vector) error {
+	inputs := make([][]byte, 0, len(v.Args))
+	for _, c := range v.Args {
+		d, err := p.fetch(ctx, c)
+		if err != nil {
+			return err
+		}
+		inputs = append(inputs, d)
+	}
+	expected, err := p.fetch(ctx, v.Output)
+	if err != nil {
+		return err
+	}
+
+	ex, err := p.execute(ctx, abi, v.Fx, inputs)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ex.output, expected) {
+		return fmt.Errorf("output doesn't match %s", v.Output)
+	}
+	return nil
+}
+
+// runnableABI returns the ABI of a function the peer accepts to run. When
+// Config.VerifyFunctions is set, functions are only run if their test vectors
+// pass. The outcome of the verification is stored once every vector ran, so
+// it only runs once per function and runtime version.
+func (p *Peer) runnableABI(ctx context.Context, fnCid cid.Cid) (*FxABI, error) {
+	abi, err := p.GetABI(ctx, fnCid)
+	if err != nil {
+		return nil, err
+	}
+	if !p.cfg.VerifyFunctions || len(abi.Vectors) == 0 {
+		return abi, nil
+	}
+
+	key := verifiedKey.ChildString(fnCid.String())
+	b, err := p.store.Get(key)
+	if err == datastore.ErrNotFound {
+		report, err := p.Verify(ctx, fnCid)
+		if err != nil {
+			return nil, err
+		}
+		b = []byte("fail")
+		if report.Pass() {
+			b = []byte("pass")
+		}
+		if err := p.store.Put(key, b); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if string(b) != "pass" {
+		return nil, &VerifyError{Fn: fnCid}
+	}
+	return abi, nil
+}
@@ -0,0 +1,102 @@
+package ipfslite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+func TestRunnableABI(t *testing.T) {
+	ctx := context.Background()
+	p := dagPeer(t)
+	p.cfg.VerifyFunctions = true
+
+	addABI := func(abi FxABI) cid.Cid {
+		b, err := json.Marshal(abi)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := p.AddFile(ctx, bytes.NewReader(b), &AddParams{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n.Cid()
+	}
+
+	bytecode, _ := cid.Decode("QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG")
+	plain := addABI(FxABI{Fxs: []string{"fx"}, Bytecode: bytecode})
+	if _, err := p.runnableABI(ctx, plain); err != nil {
+		t.Errorf("functions without vectors should run: %s", err)
+	}
+
+	tested := addABI(FxABI{
+		Fxs:      []string{"fx"},
+		Bytecode: bytecode,
+		Vectors:  []Vector{{Fx: "fx", Args: []cid.Cid{bytecode}, Output: bytecode}},
+	})
+	abi, err := p.GetABI(ctx, tested)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(abi.Vectors) != 1 || !abi.Vectors[0].Output.Equals(bytecode) {
+		t.Fatalf("vectors not decoded: %v", abi.Vectors)
+	}
+
+	// Vectors that can't be fetched don't fail and nothing is stored.
+	key := verifiedKey.ChildString(tested.String())
+	var fetchErr *FetchError
+	if _, err := p.runnableABI(ctx, tested); !errors.As(err, &fetchErr) {
+		t.Errorf("expected a fetch error, got %v", err)
+	}
+	if ok, err := p.store.Has(key); err != nil || ok {
+		t.Errorf("expected no stored outcome, got %v, %v", ok, err)
+	}
+
+	// Stored outcomes are used instead of running the vectors again.
+	if err := p.store.Put(key, []byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.runnableABI(ctx, tested); err == nil {
+		t.Error("functions with failing vectors shouldn't run")
+	}
+	if err := p.store.Put(key, []byte("pass")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.runnableABI(ctx, tested); err != nil {
+		t.Errorf("functions with passing vectors should run: %s", err)
+	}
+}
+
+func TestVerifyReport(t *testing.T) {
+	ctx := context.Background()
+	p := runtimePeer(t)
+	n, err := p.AddFile(ctx, bytes.NewReader([]byte("input")), &AddParams{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := n.Cid()
+	fn := deployWat(t, p, errorsWat, FxABI{
+		Fxs:     []string{"fail"},
+		Vectors: []Vector{{Fx: "fail", Args: []cid.Cid{in}, Output: in}},
+	})
+
+	report, err := p.Verify(ctx, fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Pass() || len(report.Results) != 1 || report.Results[0].Err == "" {
+		t.Fatalf("expected a failing vector, got %+v", report)
+	}
+	// JSON reports tell why vectors failed.
+	b, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(TrapUnreachable)) {
+		t.Errorf("expected the trap in the report, got %s", b)
+	}
+}
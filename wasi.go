@@ -0,0 +1,197 @@
+package ipfslite
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// WasiModule is the namespace of the WASI functions.
+const WasiModule = "wasi_snapshot_preview1"
+
+// Errors returned by the WASI functions defined by the host.
+const (
+	wasiErrnoBadf  = 8
+	wasiErrnoFault = 21
+	wasiErrnoSpipe = 70
+)
+
+// Rights of the standard streams returned by fd_fdstat_get.
+const (
+	wasiRightFdRead  = 1 << 1
+	wasiRightFdWrite = 1 << 6
+)
+
+// defineWasi adds the WASI functions to the linker used to instantiate a
+// module. The functions allowed by the default policy are implemented by the
+// host: what the function writes to stdout and stderr goes to its log,
+// bounded as it is written, and calls are traced like the host functions.
+// Any other WASI function allowed by a custom policy is provided by wasmtime,
+// without arguments, environment or preopened directories, and isn't traced.
+func (p *Peer) defineWasi(tree *callTree, linker *wasmtime.Linker, logs *callLog) error {
+	wasi, err := wasmtime.NewWasiInstance(tree.store, wasmtime.NewWasiConfig(), WasiModule)
+	if err != nil {
+		return err
+	}
+	if err := linker.DefineWasi(wasi); err != nil {
+		return err
+	}
+
+	trace := func(format string, args ...interface{}) {
+		if p.cfg.TraceHostCalls {
+			logs.write("trace", []byte(WasiModule+"."+fmt.Sprintf(format, args...)))
+		}
+	}
+	stdio := func(fd int32) bool {
+		return fd >= 0 && fd <= 2
+	}
+	// noArgs reports no arguments or environment variables.
+	noArgs := func(name string) func(*wasmtime.Caller, int32, int32) int32 {
+		return func(caller *wasmtime.Caller, countPtr, sizePtr int32) int32 {
+			errno := int32(0)
+			count, size := wasiMemory(caller, countPtr, 4), wasiMemory(caller, sizePtr, 4)
+			if count == nil || size == nil {
+				errno = wasiErrnoFault
+			} else {
+				binary.LittleEndian.PutUint32(count, 0)
+				binary.LittleEndian.PutUint32(size, 0)
+			}
+			trace("%s(%d, %d) -> %d", name, countPtr, sizePtr, errno)
+			return errno
+		}
+	}
+
+	funcs := map[string]interface{}{
+		"fd_write": func(caller *wasmtime.Caller, fd, iovs, iovsLen, nwritten int32) (int32, *wasmtime.Trap) {
+			if mem := callerMemory(caller); mem != nil {
+				if err := memoryLimit(mem, p.cfg.Policy.MaxMemoryPages); err != nil {
+					return 0, tree.fail(err)
+				}
+			}
+			errno := fdWrite(caller, logs, fd, iovs, iovsLen, nwritten)
+			trace("fd_write(%d, %d, %d, %d) -> %d", fd, iovs, iovsLen, nwritten, errno)
+			return errno, nil
+		},
+		"fd_close": func(fd int32) int32 {
+			errno := int32(0)
+			if !stdio(fd) {
+				errno = wasiErrnoBadf
+			}
+			trace("fd_close(%d) -> %d", fd, errno)
+			return errno
+		},
+		"fd_seek": func(fd int32, offset int64, whence, newOffset int32) int32 {
+			errno := int32(wasiErrnoSpipe)
+			if !stdio(fd) {
+				errno = wasiErrnoBadf
+			}
+			trace("fd_seek(%d, %d, %d, %d) -> %d", fd, offset, whence, newOffset, errno)
+			return errno
+		},
+		"fd_fdstat_get": func(caller *wasmtime.Caller, fd, ptr int32) int32 {
+			errno := int32(0)
+			stat := wasiMemory(caller, ptr, 24)
+			switch {
+			case !stdio(fd):
+				errno = wasiErrnoBadf
+			case stat == nil:
+				errno = wasiErrnoFault
+			default:
+				// Standard streams are character devices.
+				for i := range stat {
+					stat[i] = 0
+				}
+				stat[0] = 2
+				rights := uint64(wasiRightFdWrite)
+				if fd == 0 {
+					rights = wasiRightFdRead
+				}
+				binary.LittleEndian.PutUint64(stat[8:], rights)
+			}
+			trace("fd_fdstat_get(%d, %d) -> %d", fd, ptr, errno)
+			return errno
+		},
+		"proc_exit": func(code int32) *wasmtime.Trap {
+			trace("proc_exit(%d)", code)
+			return tree.trap(fmt.Errorf("exited with status %d", code))
+		},
+		"args_sizes_get":    noArgs("args_sizes_get"),
+		"environ_sizes_get": noArgs("environ_sizes_get"),
+		"args_get": func(argv, buf int32) int32 {
+			trace("args_get(%d, %d) -> 0", argv, buf)
+			return 0
+		},
+		"environ_get": func(environ, buf int32) int32 {
+			trace("environ_get(%d, %d) -> 0", environ, buf)
+			return 0
+		},
+	}
+
+	linker.AllowShadowing(true)
+	defer linker.AllowShadowing(false)
+	for name, f := range funcs {
+		if err := linker.DefineFunc(WasiModule, name, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fdWrite implements fd_write for stdout and stderr, writing to the log.
+func fdWrite(caller *wasmtime.Caller, logs *callLog, fd, iovs, iovsLen, nwritten int32) int32 {
+	prefix := map[int32]string{1: "stdout", 2: "stderr"}[fd]
+	if prefix == "" {
+		return wasiErrnoBadf
+	}
+	mem := callerMemory(caller)
+	if mem == nil {
+		return wasiErrnoFault
+	}
+	buf := mem.UnsafeData()
+
+	total := uint32(0)
+	for i := 0; i < int(iovsLen); i++ {
+		iov := int(iovs) + 8*i
+		if iovs < 0 || iov+8 > len(buf) {
+			return wasiErrnoFault
+		}
+		ptr := binary.LittleEndian.Uint32(buf[iov:])
+		size := binary.LittleEndian.Uint32(buf[iov+4:])
+		if uint64(ptr)+uint64(size) > uint64(len(buf)) {
+			return wasiErrnoFault
+		}
+		logs.writeStream(prefix, buf[ptr:ptr+size])
+		total += size
+	}
+	out := wasiMemory(caller, nwritten, 4)
+	if out == nil {
+		return wasiErrnoFault
+	}
+	binary.LittleEndian.PutUint32(out, total)
+	return 0
+}
+
+// wasiMemory returns size bytes of the memory of the caller at ptr, or nil if
+// they are out of bounds.
+func wasiMemory(caller *wasmtime.Caller, ptr, size int32) []byte {
+	mem := callerMemory(caller)
+	if mem == nil {
+		return nil
+	}
+	buf := mem.UnsafeData()
+	if ptr < 0 || int(ptr)+int(size) > len(buf) {
+		return nil
+	}
+	return buf[ptr : int(ptr)+int(size)]
+}
+
+// importsWasi tells if a module imports any WASI function.
+func importsWasi(m *wasmtime.Module) bool {
+	for _, imp := range m.Imports() {
+		if imp.Module() == WasiModule {
+			return true
+		}
+	}
+	return false
+}
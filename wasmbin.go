@@ -0,0 +1,211 @@
+package ipfslite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Just enough of the WASM binary format to inspect modules before compiling
+// them.
+
+var wasmMagic = []byte{0x00, 0x61, 0x73, 0x6d}
+
+// Section ids.
+const (
+	wasmCustomSection = 0
+	wasmImportSection = 2
+	wasmMemorySection = 5
+	wasmCodeSection   = 10
+)
+
+// Import kinds.
+const (
+	wasmFuncKind   = 0
+	wasmTableKind  = 1
+	wasmMemoryKind = 2
+	wasmGlobalKind = 3
+)
+
+var errWasmEOF = errors.New("unexpected end of WASM module")
+
+type wasmSection struct {
+	id     byte
+	name   string // Only for custom sections.
+	data   []byte
+	offset int // Offset of data in the module.
+}
+
+type wasmLimits struct {
+	min    uint32
+	max    *uint32
+	shared bool
+}
+
+type wasmImport struct {
+	module string
+	name   string
+	kind   byte
+	memory *wasmLimits // Only for memory imports.
+}
+
+// wasmReader reads the primitive types of the binary format.
+type wasmReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *wasmReader) byte() (byte, error) {
+	if r.pos >= len(r.b) {
+		return 0, errWasmEOF
+	}
+	c := r.b[r.pos]
+	r.pos++
+	return c, nil
+}
+
+func (r *wasmReader) u32() (uint32, error) {
+	var v uint32
+	for shift := uint(0); shift < 35; shift += 7 {
+		c, err := r.byte()
+		if err != nil {
+			return 0, err
+		}
+		v |= uint32(c&0x7f) << shift
+		if c&0x80 == 0 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("invalid LEB128 integer")
+}
+
+func (r *wasmReader) bytes(n uint32) ([]byte, error) {
+	if uint64(r.pos)+uint64(n) > uint64(len(r.b)) {
+		return nil, errWasmEOF
+	}
+	b := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b, nil
+}
+
+func (r *wasmReader) name() (string, error) {
+	n, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	b, err := r.bytes(n)
+	return string(b), err
+}
+
+func (r *wasmReader) limits() (*wasmLimits, error) {
+	flags, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	l := &wasmLimits{shared: flags&0x02 != 0}
+	if l.min, err = r.u32(); err != nil {
+		return nil, err
+	}
+	if flags&0x01 != 0 {
+		max, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		l.max = &max
+	}
+	return l, nil
+}
+
+// wasmSections splits a module in its sections.
+func wasmSections(module []byte) ([]wasmSection, error) {
+	if len(module) < 8 || !bytes.Equal(module[:4], wasmMagic) {
+		return nil, errors.New("not a WASM module")
+	}
+	r := &wasmReader{b: module, pos: 8}
+	sections := []wasmSection{}
+	for r.pos < len(module) {
+		id, err := r.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		offset := r.pos
+		data, err := r.bytes(size)
+		if err != nil {
+			return nil, err
+		}
+		s := wasmSection{id: id, data: data, offset: offset}
+		if id == wasmCustomSection {
+			sr := &wasmReader{b: data}
+			if s.name, err = sr.name(); err != nil {
+				return nil, err
+			}
+			s.data = data[sr.pos:]
+			s.offset += sr.pos
+		}
+		sections = append(sections, s)
+	}
+	return sections, nil
+}
+
+// wasmImports decodes the import section.
+func wasmImports(s wasmSection) ([]wasmImport, error) {
+	r := &wasmReader{b: s.data}
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	imports := make([]wasmImport, 0, n)
+	for i := uint32(0); i < n; i++ {
+		imp := wasmImport{}
+		if imp.module, err = r.name(); err != nil {
+			return nil, err
+		}
+		if imp.name, err = r.name(); err != nil {
+			return nil, err
+		}
+		if imp.kind, err = r.byte(); err != nil {
+			return nil, err
+		}
+		switch imp.kind {
+		case wasmFuncKind:
+			_, err = r.u32() // Type index.
+		case wasmTableKind:
+			if _, err = r.byte(); err == nil { // Element type.
+				_, err = r.limits()
+			}
+		case wasmMemoryKind:
+			imp.memory, err = r.limits()
+		case wasmGlobalKind:
+			_, err = r.bytes(2) // Value type and mutability.
+		default:
+			err = fmt.Errorf("unknown import kind %d", imp.kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		imports = append(imports, imp)
+	}
+	return imports, nil
+}
+
+// wasmMemories decodes the memory section.
+func wasmMemories(s wasmSection) ([]*wasmLimits, error) {
+	r := &wasmReader{b: s.data}
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	mems := make([]*wasmLimits, 0, n)
+	for i := uint32(0); i < n; i++ {
+		l, err := r.limits()
+		if err != nil {
+			return nil, err
+		}
+		mems = append(mems, l)
+	}
+	return mems, nil
+}